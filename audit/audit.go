@@ -0,0 +1,217 @@
+// audit.go - Append-only JSON lines log of actions taken through the web UI.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TypeCommand = "command"
+	TypeReload  = "reload"
+	TypeUser    = "user"
+	TypeLockout = "lockout"
+)
+
+type Entry struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remote_addr"`
+	Server     string    `json:"server,omitempty"`
+	Command    string    `json:"command"`
+	Allowed    bool      `json:"allowed"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+type auditLog struct {
+	mutex    sync.Mutex
+	file     *os.File
+	fpath    string
+	size     int64
+	maxSize  int64
+	maxFiles int
+}
+
+var logger *auditLog
+
+// Open the audit log at fpath, which is rotated once it grows past maxSize
+// bytes. Up to maxFiles rotated files are kept.
+func Open(fpath string, maxSize int64, maxFiles int) error {
+	l := &auditLog{fpath: fpath, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return err
+	}
+	logger = l
+	return nil
+}
+
+// Change when the log is rotated and how many rotated files are kept
+func SetRotation(maxSize int64, maxFiles int) {
+	if logger == nil {
+		return
+	}
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	logger.maxSize = maxSize
+	logger.maxFiles = maxFiles
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.fpath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open audit log '%s': %s", l.fpath, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Unable to stat audit log '%s': %s", l.fpath, err)
+	}
+	l.file = f
+	l.size = fi.Size()
+	return nil
+}
+
+func rotatedName(fpath string, n int) string {
+	return fmt.Sprintf("%s.%d", fpath, n)
+}
+
+// audit.log -> audit.log.1 -> audit.log.2 ... dropping the oldest
+func (l *auditLog) rotate() error {
+	l.file.Close()
+	os.Remove(rotatedName(l.fpath, l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		os.Rename(rotatedName(l.fpath, i), rotatedName(l.fpath, i+1))
+	}
+	if l.maxFiles > 0 {
+		if err := os.Rename(l.fpath, rotatedName(l.fpath, 1)); err != nil {
+			return fmt.Errorf("Unable to rotate audit log: %s", err)
+		}
+	} else {
+		os.Remove(l.fpath)
+	}
+	return l.open()
+}
+
+func (l *auditLog) write(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// Record an entry. Failures are reported on the console; they never stop the
+// action being audited.
+func Record(e *Entry) {
+	if logger == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if err := logger.write(e); err != nil {
+		fmt.Printf("Unable to write audit log entry: %s\n", err)
+	}
+}
+
+func (e *Entry) matches(query string) bool {
+	if query == "" {
+		return true
+	}
+	query = strings.ToLower(query)
+	for _, field := range []string{e.Type, e.User, e.RemoteAddr, e.Server,
+		e.Command, e.Reason} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// The entries in the first size bytes of fpath (all of it if size < 0)
+// that contain query, oldest first
+func readEntries(fpath string, size int64, query string) ([]*Entry, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if size >= 0 {
+		r = io.LimitReader(f, size)
+	}
+	var entries []*Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		e := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			continue
+		}
+		if e.matches(query) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Search returns up to limit entries containing query (case insensitive),
+// newest first. An empty query matches everything.
+//
+// The files are read without holding the log's mutex, so that searching
+// doesn't hold up Record. If the log is rotated meanwhile, some entries may
+// be missed or shown twice.
+func Search(query string, limit int) ([]*Entry, error) {
+	if logger == nil {
+		return nil, nil
+	}
+	logger.mutex.Lock()
+	paths := []string{logger.fpath}
+	for i := 1; i <= logger.maxFiles; i++ {
+		paths = append(paths, rotatedName(logger.fpath, i))
+	}
+	// entries written after this are left out, along with any partly
+	// written one
+	size := logger.size
+	logger.mutex.Unlock()
+
+	var entries []*Entry
+	for i, fpath := range paths {
+		if i > 0 {
+			size = -1
+		}
+		found, err := readEntries(fpath, size, query)
+		if err != nil {
+			return nil, err
+		}
+		for j := len(found) - 1; j >= 0; j-- {
+			entries = append(entries, found[j])
+			if limit > 0 && len(entries) == limit {
+				return entries, nil
+			}
+		}
+	}
+	return entries, nil
+}
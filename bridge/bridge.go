@@ -1,26 +1,107 @@
 // bridge.go: Bridge for rcon (zmq) sockets <-> websocket
 package bridge
 
+import (
+	"log"
+	"time"
+	"webqlrc/metrics"
+)
+
+const statsBufferSize = 1024
+
+const (
+	MsgRcon    = "rcon"
+	MsgMonitor = "monitor"
+	MsgStatus  = "status"
+	MsgError   = "error"
+	MsgPlayers = "players"
+	MsgStats   = "stats"
+	MsgResult  = "result"
+)
+
+// A Message is passed between the web UI and the rcon connection of a single
+// Quake Live server.
+type Message struct {
+	Type     string
+	ServerId string
+	Time     time.Time
+	Data     []byte
+	// Structured contents (e.g. a player list); sent instead of Data when set
+	Payload       interface{}
+	CorrelationId string
+	// Web client the message came from, or the only one it should go to.
+	// Messages from rcon without a client are sent to everyone.
+	Client *WebClient
+}
+
+// Output that QL sent in response to a single command
+type CommandResult struct {
+	Command  string `json:"command"`
+	Output   string `json:"output"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+}
+
 type bridge struct {
-	RconToWeb chan []byte
-	WebToRcon chan []byte
-	OutToWeb  chan []byte
-	OutToRcon chan []byte
+	RconToWeb chan *Message
+	// Stats events are also handed to storage
+	StatsToStorage chan *Message
+	WebToRcon      chan *Message
+	OutToRcon      chan *Message
+	Register       chan *WebClient
+	Unregister     chan *WebClient
+	clients        map[*WebClient]bool
 }
 
+var bridgedMessages = metrics.NewCounter("webqlrc_bridge_messages_total",
+	"Messages passed between the web UI and RCON, by direction.", "direction")
+
 var MessageBridge = &bridge{
-	RconToWeb: make(chan []byte),
-	WebToRcon: make(chan []byte),
-	OutToRcon: make(chan []byte),
-	OutToWeb:  make(chan []byte),
+	RconToWeb:      make(chan *Message),
+	StatsToStorage: make(chan *Message, statsBufferSize),
+	WebToRcon:      make(chan *Message),
+	OutToRcon:      make(chan *Message),
+	Register:       make(chan *WebClient),
+	Unregister:     make(chan *WebClient),
+	clients:        make(map[*WebClient]bool),
+}
+
+func NewMessage(msgtype, serverid string, data []byte) *Message {
+	return &Message{
+		Type:     msgtype,
+		ServerId: serverid,
+		Time:     time.Now(),
+		Data:     data,
+	}
+}
+
+func (b *bridge) store(msg *Message) {
+	select {
+	case b.StatsToStorage <- msg:
+	default:
+		log.Printf("Stats storage is falling behind, dropped %s stats event",
+			msg.ServerId)
+	}
 }
 
 func (b *bridge) PassMessages() {
 	for {
 		select {
+		case c := <-b.Register:
+			b.clients[c] = true
+		case c := <-b.Unregister:
+			b.removeClient(c)
 		case twmsg := <-b.RconToWeb:
-			b.OutToWeb <- twmsg
+			bridgedMessages.Inc("rcon_to_web")
+			if twmsg.Type == MsgStats {
+				b.store(twmsg)
+			}
+			if twmsg.Client != nil {
+				b.sendTo(twmsg.Client, twmsg)
+			} else {
+				b.broadcast(twmsg)
+			}
 		case trmsg := <-b.WebToRcon:
+			bridgedMessages.Inc("web_to_rcon")
 			b.OutToRcon <- trmsg
 		}
 	}
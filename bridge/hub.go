@@ -0,0 +1,68 @@
+// hub.go: Registry of web clients that rcon messages are fanned out to
+package bridge
+
+const clientSendBufferSize = 256
+
+// A WebClient is a single subscriber (i.e. a browser's websocket) that
+// receives every message coming from rcon.
+type WebClient struct {
+	Send chan *Message
+	// Only receives messages addressed to it (e.g. API requests)
+	directOnly bool
+	// Closed once the client is removed
+	removed chan struct{}
+}
+
+func NewWebClient() *WebClient {
+	return &WebClient{Send: make(chan *Message, clientSendBufferSize),
+		removed: make(chan struct{})}
+}
+
+// A client that doesn't receive broadcasts, only replies to its own commands
+func NewDirectClient() *WebClient {
+	return &WebClient{Send: make(chan *Message, 4), directOnly: true,
+		removed: make(chan struct{})}
+}
+
+// True once a direct client has gone away: it has given up waiting for the
+// replies to its commands, so any still queued shouldn't be run. Commands
+// from a websocket still run after it closes.
+func (c *WebClient) Abandoned() bool {
+	if !c.directOnly {
+		return false
+	}
+	select {
+	case <-c.removed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *bridge) removeClient(c *WebClient) {
+	if _, ok := b.clients[c]; ok {
+		delete(b.clients, c)
+		close(c.Send)
+		close(c.removed)
+	}
+}
+
+func (b *bridge) sendTo(c *WebClient, msg *Message) {
+	if _, ok := b.clients[c]; !ok {
+		return
+	}
+	select {
+	case c.Send <- msg:
+	default:
+		// Client can't keep up; drop it instead of stalling everyone else
+		b.removeClient(c)
+	}
+}
+
+func (b *bridge) broadcast(msg *Message) {
+	for c := range b.clients {
+		if !c.directOnly {
+			b.sendTo(c, msg)
+		}
+	}
+}
@@ -1,4 +1,4 @@
 @echo off
 del webqlrc.exe
 cls
-go build -i %cd%\cmd\webqlrc\webqlrc.go
\ No newline at end of file
+go build -o webqlrc.exe .\cmd\webqlrc
\ No newline at end of file
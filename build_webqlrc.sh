@@ -1,2 +1,2 @@
 rm -rf webqlrc
-go build -i cmd/webqlrc/webqlrc.go
+go build -o webqlrc ./cmd/webqlrc
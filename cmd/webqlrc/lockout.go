@@ -0,0 +1,76 @@
+// lockout.go - The lockout command: show and clear failed web login lockouts.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+	"webqlrc/config"
+)
+
+const lockoutUsage = `Usage: %s [--confdir dir] lockout <command> [arguments]
+
+Commands:
+  list                         List user names and addresses with failed logins
+  clear <username|address>     Clear the failed logins and lockout of a user
+                               name or address
+  clear -all                   Clear all failed logins and lockouts
+`
+
+func lockoutCommandUsage() {
+	fmt.Fprintf(os.Stderr, lockoutUsage, os.Args[0])
+}
+
+func runLockoutCommand(args []string) error {
+	if len(args) == 0 {
+		lockoutCommandUsage()
+		return errors.New("No lockout command given")
+	}
+	cmd, args := args[0], args[1:]
+
+	switch {
+	case cmd == "list" && len(args) == 0:
+		failures, err := config.ListLoginFailures()
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(failures))
+		for key := range failures {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		now := time.Now()
+		for _, key := range keys {
+			f := failures[key]
+			line := fmt.Sprintf("%-40s %3d failed, last %s",
+				config.DescribeLoginKey(key), f.Count,
+				f.Last.Format(time.RFC3339))
+			if now.Before(f.LockedUntil) {
+				line += ", locked until " + f.LockedUntil.Format(time.RFC3339)
+			}
+			fmt.Println(line)
+		}
+		return nil
+	case cmd == "clear" && len(args) == 1:
+		name := args[0]
+		if name == "-all" {
+			name = ""
+		}
+		cleared, err := config.ClearLockout(name)
+		if err != nil {
+			return err
+		}
+		if len(cleared) == 0 {
+			fmt.Println("No failed logins to clear.")
+		}
+		for _, key := range cleared {
+			fmt.Printf("Cleared failed logins for %s.\n",
+				config.DescribeLoginKey(key))
+		}
+		return nil
+	}
+	lockoutCommandUsage()
+	return fmt.Errorf("Invalid lockout command: %s", cmd)
+}
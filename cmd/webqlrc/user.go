@@ -0,0 +1,93 @@
+// user.go - The user command: manage web users without starting the server.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"webqlrc/config"
+)
+
+const userUsage = `Usage: %s [--confdir dir] user <command> [arguments]
+
+Commands:
+  list                                     List web users and their roles
+  add [-role role] [-passwordfile file] <username>
+                                           Add a web user (default role: viewer)
+  del <username>                           Delete a web user and their API tokens
+  passwd [-passwordfile file] <username>   Change a web user's password
+  role <username> <role>                   Change a web user's role
+
+The password is asked for unless -passwordfile is given ('-' reads it from
+stdin). The last admin user can't be deleted or given another role.
+`
+
+func userCommandUsage() {
+	fmt.Fprintf(os.Stderr, userUsage, os.Args[0])
+}
+
+func runUserCommand(args []string) error {
+	if len(args) == 0 {
+		userCommandUsage()
+		return errors.New("No user command given")
+	}
+	cmd, args := args[0], args[1:]
+	fs := flag.NewFlagSet("user "+cmd, flag.ContinueOnError)
+	fs.Usage = userCommandUsage
+	role := fs.String("role", "viewer", "Role for the new user")
+	passwordFile := fs.String("passwordfile", "",
+		"File to read the password from ('-' for stdin)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	args = fs.Args()
+
+	switch {
+	case cmd == "list" && len(args) == 0:
+		users, err := config.ListWebUsers()
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			fmt.Printf("%-24s %s\n", u.Username, u.Role)
+		}
+		return nil
+	case cmd == "add" && len(args) == 1:
+		password, err := config.ReadPassword(*passwordFile,
+			fmt.Sprintf("Enter the password for '%s': ", args[0]))
+		if err != nil {
+			return err
+		}
+		if err := config.AddWebUser(args[0], password, *role); err != nil {
+			return err
+		}
+		fmt.Printf("Added web user '%s' with role '%s'.\n", args[0], *role)
+		return nil
+	case cmd == "del" && len(args) == 1:
+		if err := config.DeleteWebUser(args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted web user '%s'.\n", args[0])
+		return nil
+	case cmd == "passwd" && len(args) == 1:
+		password, err := config.ReadPassword(*passwordFile,
+			fmt.Sprintf("Enter the new password for '%s': ", args[0]))
+		if err != nil {
+			return err
+		}
+		if err := config.SetWebUserPassword(args[0], password); err != nil {
+			return err
+		}
+		fmt.Printf("Changed password for web user '%s'.\n", args[0])
+		return nil
+	case cmd == "role" && len(args) == 2:
+		if err := config.SetWebUserRole(args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Web user '%s' now has role '%s'.\n", args[0], args[1])
+		return nil
+	}
+	userCommandUsage()
+	return fmt.Errorf("Invalid user command: %s", cmd)
+}
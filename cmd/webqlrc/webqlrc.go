@@ -2,12 +2,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"webqlrc/bridge"
 	"webqlrc/config"
 	"webqlrc/rcon"
+	"webqlrc/storage"
 	"webqlrc/web"
 )
 
@@ -15,12 +20,22 @@ const (
 	bothConfigureFlag = "config"
 	rconConfigureFlag = "rconconfig"
 	webConfigureFlag  = "webconfig"
+	rotateKeyFlag     = "rotatekey"
+	apiTokenFlag      = "apitoken"
+	revokeTokensFlag  = "revoketokens"
+	confDirFlag       = "confdir"
+	checkConfigFlag   = "checkconfig"
 )
 
 var (
 	doRconAndWebConfig bool
 	doRconConfig       bool
 	doWebConfig        bool
+	doRotateKey        bool
+	apiTokenUser       string
+	revokeTokensUser   string
+	confDir            string
+	doCheckConfig      bool
 )
 
 func init() {
@@ -33,10 +48,55 @@ func init() {
 
 	flag.BoolVar(&doWebConfig, webConfigureFlag, false,
 		"Generate the web configuration file")
+
+	flag.BoolVar(&doRotateKey, rotateKeyFlag, false,
+		"Generate a new cookie encryption key, logging out all web users")
+
+	flag.StringVar(&apiTokenUser, apiTokenFlag, "",
+		"Create a REST API token for the given web user")
+
+	flag.StringVar(&revokeTokensUser, revokeTokensFlag, "",
+		"Revoke all REST API tokens belonging to the given web user")
+
+	flag.StringVar(&confDir, confDirFlag, "",
+		fmt.Sprintf("Configuration directory (default: $%s, ./conf if it exists, or the user configuration directory)",
+			config.ConfigurationDirectoryEnv))
+
+	flag.BoolVar(&doCheckConfig, checkConfigFlag, false,
+		"Check the configuration files for problems and exit")
+
+	// Answers for --config, --rconconfig and --webconfig
+	config.RegisterPresetFlags(flag.CommandLine)
 }
 
 func main() {
 	flag.Parse()
+	config.SetConfigurationDirectory(confDir)
+	err := config.LoadPresetEnv()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// Subcommands
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "user":
+			if err := runUserCommand(flag.Args()[1:]); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		case "lockout":
+			if err := runLockoutCommand(flag.Args()[1:]); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		default:
+			fmt.Printf("Unknown command '%s'\n", flag.Arg(0))
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
 
 	// --config and (--rconconfig or --webconfig) are mutually exclusive
 	if doRconAndWebConfig && (doRconConfig || doWebConfig) {
@@ -52,10 +112,12 @@ func main() {
 		err := config.CreateRconConfig()
 		if err != nil {
 			fmt.Printf("Unable to create RCON configuration: %s\n", err)
+			os.Exit(1)
 		}
 		err = config.CreateWebConfig()
 		if err != nil {
 			fmt.Printf("Unable to create web configuration: %s\n", err)
+			os.Exit(1)
 		}
 		os.Exit(0)
 	}
@@ -66,6 +128,7 @@ func main() {
 		err := config.CreateRconConfig()
 		if err != nil {
 			fmt.Printf("Unable to create RCON configuration: %s\n", err)
+			os.Exit(1)
 		}
 	}
 	// --webconfig
@@ -75,25 +138,72 @@ func main() {
 		err := config.CreateWebConfig()
 		if err != nil {
 			fmt.Printf("Unable to create web configuration: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	// --rotatekey
+	if doRotateKey {
+		fmt.Printf("webqlrc %s: Rotate cookie encryption key\n", config.Version)
+		_, err := config.GenerateCookieKey()
+		if err != nil {
+			fmt.Printf("Unable to rotate cookie encryption key: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Created new cookie key file '%s' in '%s' directory.\n",
+			config.WebCookieKeyFilename, config.ConfigurationDirectory)
+		// A running webqlrc checks this on every request
+		err = config.RevokeAllWebUserSessions()
+		if err != nil {
+			fmt.Printf("Unable to revoke web sessions: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Existing web sessions have been revoked. Reload a running webqlrc (SIGHUP or the reload page) for it to use the new key.")
+	}
+	// --apitoken
+	if apiTokenUser != "" {
+		token, err := config.CreateAPIToken(apiTokenUser)
+		if err != nil {
+			fmt.Printf("Unable to create API token: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("API token for web user '%s' (this is only shown once):\n%s\n",
+			apiTokenUser, token)
+	}
+	// --revoketokens
+	if revokeTokensUser != "" {
+		n, err := config.DeleteAPITokens(revokeTokensUser)
+		if err != nil {
+			fmt.Printf("Unable to revoke API tokens: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Revoked %d API token(s) for web user '%s'.\n", n,
+			revokeTokensUser)
+	}
+	// --checkconfig
+	if doCheckConfig {
+		if !checkConfig() {
+			os.Exit(1)
 		}
 	}
-	if doRconAndWebConfig || doRconConfig || doWebConfig {
+	if doRconAndWebConfig || doRconConfig || doWebConfig || doRotateKey ||
+		doCheckConfig ||
+		apiTokenUser != "" || revokeTokensUser != "" {
 		os.Exit(0)
 	}
 
 	// Verify existence and ability to read config files
-	_, err := config.ReadConfig(config.RCON)
+	_, err = config.ReadConfig(config.RCON)
 	if err != nil {
-		fmt.Printf("Could not read RCON configuration file '%s' in '%s' directory\n",
-			config.RconConfigurationFilename, config.ConfigurationDirectory)
+		fmt.Printf("Could not read RCON configuration file '%s' in '%s' directory: %s\n",
+			config.RconConfigurationFilename, config.ConfigurationDirectory, err)
 		fmt.Printf("You must first generate the file with: %s --%s or --%s\n",
 			os.Args[0], bothConfigureFlag, rconConfigureFlag)
 		os.Exit(1)
 	}
 	_, err = config.ReadConfig(config.WEB)
 	if err != nil {
-		fmt.Printf("Could not read web configuration file: '%s' in '%s' directory\n",
-			config.WebConfigurationFilename, config.ConfigurationDirectory)
+		fmt.Printf("Could not read web configuration file: '%s' in '%s' directory: %s\n",
+			config.WebConfigurationFilename, config.ConfigurationDirectory, err)
 		fmt.Printf("You must first generate the file with: %s --%s or --%s\n",
 			os.Args[0], bothConfigureFlag, webConfigureFlag)
 		os.Exit(1)
@@ -108,9 +218,102 @@ func main() {
 		os.Exit(1)
 	}
 
+	for _, w := range config.CheckPermissions() {
+		log.Printf("WARNING: %s", w)
+	}
+
 	// Everything looks good
 	go bridge.MessageBridge.PassMessages()
 	fmt.Printf("Starting webqlrc v%s\n", config.Version)
+	err = storage.Start()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	rcon.Start()
+	go reloadOnSignal()
+	exitCode := make(chan int)
+	go shutdownOnSignal(exitCode)
 	web.Start()
+	os.Exit(<-exitCode)
+}
+
+// Re-read the configuration files on SIGHUP
+func reloadOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		<-web.Started()
+		web.Reload("", "SIGHUP")
+	}
+}
+
+// Shut down in order on SIGINT or SIGTERM: the web servers and websockets
+// first so nothing new arrives, then commands already passed on to RCON are
+// finished and the ZMQ connections closed. Stats events are stored last, once
+// RCON can no longer produce any. Sends 1 to exitCode if this took longer
+// than the configured deadline or failed.
+func shutdownOnSignal(exitCode chan<- int) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	s := <-sig
+	// A second signal kills the process straight away
+	signal.Stop(sig)
+	// Signals during startup are acted on once there is something to stop
+	<-web.Started()
+	timeout := web.ShutdownTimeout()
+	log.Printf("webqlrcon %s: Received %s, shutting down (deadline %s)",
+		config.Version, s, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	steps := []struct {
+		name string
+		stop func(context.Context) error
+	}{
+		{"web server", web.Shutdown},
+		{"RCON commands", rcon.Drain},
+		{"RCON connections", rcon.Shutdown},
+		{"stats storage", storage.Stop},
+	}
+	code := 0
+	for _, step := range steps {
+		if err := step.stop(ctx); err != nil {
+			log.Printf("WARNING: shutting down %s: %s", step.name, err)
+			code = 1
+		}
+	}
+	log.Printf("webqlrcon %s: Shut down", config.Version)
+	exitCode <- code
+}
+
+// Report problems with the configuration files without changing them.
+// Returns false if webqlrc would not start.
+func checkConfig() bool {
+	fmt.Printf("webqlrc %s: Checking configuration in '%s' directory\n",
+		config.Version, config.ConfigurationDirectory)
+	ok := true
+	for _, ct := range []config.ConfigType{config.RCON, config.WEB} {
+		notes, err := config.CheckConfig(ct)
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			ok = false
+			continue
+		}
+		for _, n := range notes {
+			fmt.Printf("NOTE: %s\n", n)
+		}
+	}
+	if err := config.VerifyWebUserFile(); err != nil {
+		fmt.Printf("ERROR: Unable to read web user file '%s': %s\n",
+			config.WebUserFilename, err)
+		ok = false
+	}
+	for _, w := range config.CheckPermissions() {
+		fmt.Printf("WARNING: %s\n", w)
+	}
+	if ok {
+		fmt.Println("Configuration OK.")
+	}
+	return ok
 }
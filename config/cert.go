@@ -0,0 +1,81 @@
+// cert.go - Self-signed TLS certificate generation for the web interface.
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	WebTLSCertFilename = "webqlrc.crt"
+	WebTLSKeyFilename  = "webqlrc.key"
+	selfSignedValidFor = 5 * 365 * 24 * time.Hour
+)
+
+// Generate a self-signed certificate and key valid for the given host names
+// and IP addresses, along with localhost and this machine's host name.
+// Returns the paths of the certificate and key files.
+func generateSelfSignedCert(hosts []string) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to generate private key: %s", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to generate serial number: %s", err)
+	}
+	notBefore := time.Now()
+	tmpl := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"webqlrc"},
+			CommonName:   "webqlrc self-signed",
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(selfSignedValidFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	hosts = append(hosts, "localhost", "127.0.0.1", "::1")
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey,
+		key)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to create certificate: %s", err)
+	}
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to encode private key: %s", err)
+	}
+
+	err = writeConfigDirFile(WebTLSCertFilename, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return "", "", err
+	}
+	err = writeConfigDirFile(WebTLSKeyFilename, pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	return FilePath(WebTLSCertFilename), FilePath(WebTLSKeyFilename), nil
+}
@@ -6,8 +6,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"path"
 	"runtime"
 	"strconv"
 	"strings"
@@ -19,42 +19,139 @@ import (
 )
 
 var (
-	newline  string = getNewLineForOS()
-	WebRoles        = map[string]httpauth.Role{
-		"admin": 100,
+	errInvalidYesNo        = errors.New("Please answer 'y' or 'n'.")
+	newline         string = getNewLineForOS()
+	stdin                  = bufio.NewReader(os.Stdin)
+	WebRoles               = map[string]httpauth.Role{
+		"admin":     100,
+		"moderator": 50,
+		"viewer":    10,
 	}
 )
 
 const (
-	defaultRconShowOnConsole             = false
-	defaultRconPollTimeOut               = 50
-	defaultWebMaxMessageSize             = 512
-	defaultWebPongTimeout                = 60
-	defaultWebSendTimeout                = 10
-	ConfigurationDirectory               = "conf"
-	RconConfigurationFilename            = "rcon.conf"
-	WebConfigurationFilename             = "web.conf"
-	WebUserFilename                      = "web.user"
-	Version                              = "0.1"
-	RCON                      configType = 0
-	WEB                       configType = 1
+	defaultRconShowOnConsole                   = false
+	defaultRconPollTimeOut                     = 50
+	defaultRconReconnectInterval               = 1000
+	defaultRconReconnectMaxInterval            = 30000
+	defaultRconServerId                        = "default"
+	defaultRconResponseQuietPeriod             = 250
+	defaultRconResponseTimeout                 = 3000
+	defaultWebMaxMessageSize                   = 512
+	defaultWebPongTimeout                      = 60
+	defaultWebSendTimeout                      = 10
+	defaultWebAuditMaxSize                     = 10 * 1024 * 1024
+	defaultWebAuditMaxFiles                    = 5
+	defaultWebSessionLifetime                  = 12 * 60 * 60
+	defaultWebSessionIdleTimeout               = 30 * 60
+	defaultWebLoginMaxAttempts                 = 5
+	defaultWebLoginMaxPerAddress               = 20
+	defaultWebLoginDelay                       = 1
+	defaultWebLoginLockout                     = 15 * 60
+	defaultWebShutdownTimeout                  = 10
+	RconConfigurationFilename                  = "rcon.conf"
+	WebConfigurationFilename                   = "web.conf"
+	WebUserFilename                            = "web.user"
+	AuditLogFilename                           = "audit.log"
+	StatsDatabaseFilename                      = "stats.db"
+	Version                                    = "0.1"
+	RCON                            ConfigType = 0
+	WEB                             ConfigType = 1
 )
 
-type configType int
+type ConfigType int
+
+type RconServerConfig struct {
+	Id                string
+	QlZmqHost         string
+	QlZmqRconPort     int
+	QlZmqRconPassword string
+	// Optional stats publisher (zmq_stats_enable). Disabled when the port is
+	// 0; the host defaults to QlZmqHost.
+	QlZmqStatsHost     string `json:",omitempty"`
+	QlZmqStatsPort     int    `json:",omitempty"`
+	QlZmqStatsPassword string `json:",omitempty"`
+}
+
+func (sc *RconServerConfig) StatsEnabled() bool {
+	return sc.QlZmqStatsPort != 0
+}
+
+func (sc *RconServerConfig) StatsAddress() string {
+	host := sc.QlZmqStatsHost
+	if host == "" {
+		host = sc.QlZmqHost
+	}
+	return fmt.Sprintf("tcp://%s:%d", host, sc.QlZmqStatsPort)
+}
 
 type rconConfig struct {
-	QlZmqHost            string
-	QlZmqRconPort        int
-	QlZmqRconPassword    string
-	QlZmqRconPollTimeout time.Duration
-	QlZmqShowOnConsole   bool
+	Version                   int
+	Servers                   []*RconServerConfig
+	QlZmqRconPollTimeout      time.Duration
+	QlZmqReconnectInterval    time.Duration
+	QlZmqReconnectMaxInterval time.Duration
+	// A command's response is complete once QL has been quiet this long
+	// (ms), or when nothing at all was received before the timeout (ms)
+	QlZmqResponseQuietPeriod time.Duration
+	QlZmqResponseTimeout     time.Duration
+	QlZmqShowOnConsole       bool
+	// Single server settings from files created before multiple servers
+	// were supported
+	QlZmqHost         string `json:",omitempty"`
+	QlZmqRconPort     int    `json:",omitempty"`
+	QlZmqRconPassword string `json:",omitempty"`
+}
+
+// Command patterns (e.g. "kick", "zmq_*") a role may or may not send.
+// Deny wins over Allow.
+type rolePermissions struct {
+	Allow []string
+	Deny  []string
 }
 
 type webConfig struct {
-	WebMaxMessageSize int64
-	WebPongTimeout    int
-	WebSendTimeout    int
-	WebServerPort     int
+	Version            int
+	WebMaxMessageSize  int64
+	WebPongTimeout     int
+	WebSendTimeout     int
+	WebServerPort      int
+	WebRolePermissions map[string]*rolePermissions
+	// Origins (e.g. "https://ql.example.com") allowed to open websockets.
+	// When empty, only pages served by webqlrc itself are allowed.
+	WebAllowedOrigins []string
+	// Size in bytes at which the audit log is rotated, and the number of
+	// rotated files to keep
+	WebAuditMaxSize  int64
+	WebAuditMaxFiles int
+	// Serve HTTPS when both are set. If WebHTTPRedirectPort is set, plain
+	// HTTP requests on that port are redirected to HTTPS.
+	WebTLSCertFile      string
+	WebTLSKeyFile       string
+	WebHTTPRedirectPort int
+	// Seconds after logging in, and after the last request or command, that
+	// a web login session ends
+	WebSessionLifetime    int
+	WebSessionIdleTimeout int
+	// Failed logins for a user name, or from an address, after which further
+	// attempts are refused for WebLoginLockout seconds. Before that each
+	// failure doubles the wait before the next attempt, starting from
+	// WebLoginDelay seconds.
+	WebLoginMaxAttempts   int
+	WebLoginMaxPerAddress int
+	WebLoginDelay         int
+	WebLoginLockout       int
+	// Address (e.g. "127.0.0.1:9117") to serve /metrics on without
+	// authentication. When empty, /metrics is served to admins on
+	// WebServerPort.
+	WebMetricsAddress string
+	// Seconds to wait for websockets, RCON commands and stats to finish when
+	// shutting down
+	WebShutdownTimeout int
+}
+
+func (wc *webConfig) TLSEnabled() bool {
+	return wc.WebTLSCertFile != "" && wc.WebTLSKeyFile != ""
 }
 
 type Config struct {
@@ -62,6 +159,21 @@ type Config struct {
 	Web  *webConfig
 }
 
+func defaultWebRolePermissions() map[string]*rolePermissions {
+	return map[string]*rolePermissions{
+		"admin": {
+			Allow: []string{"*"},
+		},
+		"moderator": {
+			Allow: []string{"say", "tell", "kick", "clientkick", "mute",
+				"unmute", "tempban", "status", "players", "serverinfo"},
+			Deny: []string{"quit", "map", "rcon_password", "zmq_*"},
+		},
+		// read-only
+		"viewer": {},
+	}
+}
+
 func getNewLineForOS() string {
 	if runtime.GOOS == "windows" {
 		return "\r\n"
@@ -70,48 +182,210 @@ func getNewLineForOS() string {
 	}
 }
 
-func ReadConfig(ct configType) (*Config, error) {
-	var fpath string
-	cfg := &Config{}
-
-	if ct == RCON {
-		fpath = path.Join(ConfigurationDirectory, RconConfigurationFilename)
-		cfg.Rcon = &rconConfig{}
-	} else if ct == WEB {
-		fpath = path.Join(ConfigurationDirectory, WebConfigurationFilename)
-		cfg.Web = &webConfig{}
+// Read, upgrade and validate a configuration file. Files written by older
+// versions are upgraded in place, keeping a backup of the original.
+func ReadConfig(ct ConfigType) (*Config, error) {
+	cfg, contents, from, err := readConfig(ct)
+	if err != nil {
+		return nil, err
 	}
+	if contents != nil {
+		name := configFilename(ct)
+		backup := fmt.Sprintf("%s.v%d.bak", name, from)
+		err = writeConfigDirFile(backup, contents, 0600)
+		if err == nil {
+			if ct == RCON {
+				err = writeConfigFile(cfg.Rcon)
+			} else {
+				err = writeConfigFile(cfg.Web)
+			}
+		}
+		if err != nil {
+			fmt.Printf("Unable to save upgraded configuration file '%s': %s\n",
+				name, err)
+		} else {
+			fmt.Printf("Upgraded configuration file '%s' from version %d; the original was saved as '%s'.\n",
+				name, from, backup)
+		}
+	}
+	return cfg, nil
+}
 
-	f, err := os.Open(fpath)
+// Report what is wrong with a configuration file without changing it.
+// Returns notes about changes ReadConfig would make to the file.
+func CheckConfig(ct ConfigType) ([]string, error) {
+	_, contents, from, err := readConfig(ct)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to read config file.")
+		return nil, err
 	}
-	defer f.Close()
+	if contents != nil {
+		return []string{fmt.Sprintf("'%s' will be upgraded from version %d",
+			configFilename(ct), from)}, nil
+	}
+	return nil, nil
+}
 
-	r := bufio.NewReader(f)
-	dec := json.NewDecoder(r)
+func configFilename(ct ConfigType) string {
+	if ct == RCON {
+		return RconConfigurationFilename
+	}
+	return WebConfigurationFilename
+}
 
+// Returns the original file contents, and the version they were written
+// in, if the file needs upgrading.
+func readConfig(ct ConfigType) (*Config, []byte, int, error) {
+	cfg := &Config{}
+	var cf configFile
 	if ct == RCON {
-		err = dec.Decode(cfg.Rcon)
+		cfg.Rcon = &rconConfig{}
+		cf = cfg.Rcon
 	} else if ct == WEB {
-		err = dec.Decode(cfg.Web)
+		cfg.Web = &webConfig{}
+		cf = cfg.Web
 	}
 
+	fpath := FilePath(configFilename(ct))
+	contents, err := ioutil.ReadFile(fpath)
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, fmt.Errorf("Unable to read config file '%s': %s",
+			fpath, err)
+	}
+	if err = json.Unmarshal(contents, cf); err != nil {
+		return nil, nil, 0, fmt.Errorf("Unable to parse config file '%s': %s",
+			fpath, err)
+	}
+	from, err := cf.migrate()
+	if err != nil {
+		return nil, nil, 0, err
 	}
+	cf.applyDefaults()
+	if err = cf.Validate(); err != nil {
+		return nil, nil, 0, fmt.Errorf("%s: %s", fpath, err)
+	}
+	if ct == RCON && from == rconConfigVersion ||
+		ct == WEB && from == webConfigVersion {
+		contents = nil
+	}
+	return cfg, contents, from, nil
+}
 
-	return cfg, nil
+// Returns the configured server with the given id, or nil if there is none.
+func (rc *rconConfig) Server(id string) *RconServerConfig {
+	for _, s := range rc.Servers {
+		if s.Id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (rc *rconConfig) upgradeSingleServer() {
+	if len(rc.Servers) == 0 && rc.QlZmqHost != "" {
+		rc.Servers = []*RconServerConfig{{
+			Id:                defaultRconServerId,
+			QlZmqHost:         rc.QlZmqHost,
+			QlZmqRconPort:     rc.QlZmqRconPort,
+			QlZmqRconPassword: rc.QlZmqRconPassword,
+		}}
+		rc.QlZmqHost = ""
+		rc.QlZmqRconPort = 0
+		rc.QlZmqRconPassword = ""
+	}
 }
 
 func CreateRconConfig() error {
-	reader := bufio.NewReader(os.Stdin)
+	if err := checkStdinPasswords(); err != nil {
+		return err
+	}
+	reader := stdin
+	p := RconPreset
 	rconcfg := &rconConfig{
-		QlZmqRconPollTimeout: defaultRconPollTimeOut,
-		QlZmqShowOnConsole:   defaultRconShowOnConsole,
+		Version:                   rconConfigVersion,
+		QlZmqRconPollTimeout:      defaultRconPollTimeOut,
+		QlZmqReconnectInterval:    defaultRconReconnectInterval,
+		QlZmqReconnectMaxInterval: defaultRconReconnectMaxInterval,
+		QlZmqResponseQuietPeriod:  defaultRconResponseQuietPeriod,
+		QlZmqResponseTimeout:      defaultRconResponseTimeout,
+		QlZmqShowOnConsole:        defaultRconShowOnConsole,
+	}
+	if p.PollTimeout != 0 {
+		rconcfg.QlZmqRconPollTimeout = time.Duration(p.PollTimeout)
+	}
+	if p.ReconnectInterval != 0 {
+		rconcfg.QlZmqReconnectInterval = time.Duration(p.ReconnectInterval)
+	}
+	if p.ReconnectMaxInterval != 0 {
+		rconcfg.QlZmqReconnectMaxInterval = time.Duration(p.ReconnectMaxInterval)
+	}
+	if p.ResponseQuietPeriod != 0 {
+		rconcfg.QlZmqResponseQuietPeriod = time.Duration(p.ResponseQuietPeriod)
+	}
+	if p.ResponseTimeout != 0 {
+		rconcfg.QlZmqResponseTimeout = time.Duration(p.ResponseTimeout)
+	}
+
+	addServer := true
+	for addServer {
+		srvcfg, err := createRconServerConfig(reader, rconcfg, p)
+		if err != nil {
+			return err
+		}
+		rconcfg.Servers = append(rconcfg.Servers, srvcfg)
+		// Presets only describe the first server
+		p = &RconPresets{}
+
+		if NonInteractive {
+			break
+		}
+		yes, err := askYesNo(reader, "Add another Quake Live server? (y/n): ")
+		if err != nil {
+			return err
+		}
+		addServer = yes
+	}
+	err := writeConfigFile(rconcfg)
+	if err != nil {
+		return fmt.Errorf("Unable to create RCON configuration file: %s", err)
 	}
+	fmt.Printf("Created RCON configuration file '%s' in '%s' directory.\n",
+		RconConfigurationFilename, ConfigurationDirectory)
+	return nil
+}
 
-	validHost := false
+func createRconServerConfig(reader *bufio.Reader, rconcfg *rconConfig,
+	p *RconPresets) (*RconServerConfig, error) {
+	srvcfg := &RconServerConfig{}
+
+	if p.ServerId != "" {
+		if err := validateServerId(p.ServerId); err != nil {
+			return nil, err
+		}
+		srvcfg.Id = p.ServerId
+	} else if NonInteractive {
+		// A single server keeps the name older files were upgraded with
+		srvcfg.Id = defaultRconServerId
+	}
+	validId := srvcfg.Id != ""
+	for !validId {
+		fmt.Print("Enter a short unique name for this server (e.g. ffa1): ")
+
+		id, err := getServerId(reader)
+		if err != nil {
+			fmt.Println(err)
+		} else if rconcfg.Server(id) != nil {
+			fmt.Printf("A server named '%s' has already been entered.\n", id)
+		} else {
+			srvcfg.Id = id
+			validId = true
+		}
+	}
+	if p.Host != "" {
+		srvcfg.QlZmqHost = p.Host
+	} else if NonInteractive {
+		return nil, errMissingPreset("ZeroMQ QL RCON host", &p.Host)
+	}
+	validHost := srvcfg.QlZmqHost != ""
 	for !validHost {
 		fmt.Print("Enter your ZeroMQ QL RCON hostname or IP address: ")
 
@@ -119,11 +393,19 @@ func CreateRconConfig() error {
 		if err != nil {
 			fmt.Println(err)
 		} else {
-			rconcfg.QlZmqHost = hostname
+			srvcfg.QlZmqHost = hostname
 			validHost = true
 		}
 	}
-	validPort := false
+	if p.Port != 0 {
+		if err := checkPresetPort("ZeroMQ QL RCON port", p.Port); err != nil {
+			return nil, err
+		}
+		srvcfg.QlZmqRconPort = p.Port
+	} else if NonInteractive {
+		return nil, errMissingPreset("ZeroMQ QL RCON port", &p.Port)
+	}
+	validPort := srvcfg.QlZmqRconPort != 0
 	for !validPort {
 		fmt.Print("Enter your ZeroMQ QL RCON port number: ")
 
@@ -131,11 +413,19 @@ func CreateRconConfig() error {
 		if err != nil {
 			fmt.Println(err)
 		} else {
-			rconcfg.QlZmqRconPort = port
+			srvcfg.QlZmqRconPort = port
 			validPort = true
 		}
 	}
-	validPassword := false
+	password, err := presetPassword(p.Password, p.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	if password == "" && NonInteractive {
+		return nil, errMissingPreset("ZeroMQ QL RCON password", &p.PasswordFile)
+	}
+	srvcfg.QlZmqRconPassword = password
+	validPassword := password != ""
 	for !validPassword {
 
 		fmt.Print("Enter your ZeroMQ QL RCON password: ")
@@ -143,27 +433,102 @@ func CreateRconConfig() error {
 		if err != nil {
 			fmt.Println(err)
 		} else {
-			rconcfg.QlZmqRconPassword = password
+			srvcfg.QlZmqRconPassword = password
 			validPassword = true
 		}
 	}
-	err := writeConfigFile(rconcfg)
+
+	if p.StatsPort == 0 {
+		if NonInteractive {
+			return srvcfg, nil
+		}
+		stats, err := askYesNo(reader,
+			"Subscribe to this server's ZeroMQ stats publisher? (y/n): ")
+		if err != nil || !stats {
+			return srvcfg, nil
+		}
+	} else if err := checkPresetPort("ZeroMQ QL stats port",
+		p.StatsPort); err != nil {
+		return nil, err
+	}
+	srvcfg.QlZmqStatsHost = p.StatsHost
+	srvcfg.QlZmqStatsPort = p.StatsPort
+	validPort = srvcfg.QlZmqStatsPort != 0
+	for !validPort {
+		fmt.Print("Enter your ZeroMQ QL stats port number: ")
+
+		port, err := getPort(reader)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			srvcfg.QlZmqStatsPort = port
+			validPort = true
+		}
+	}
+	password, err = presetPassword(p.StatsPassword, p.StatsPasswordFile)
 	if err != nil {
-		return fmt.Errorf("Unable to create RCON configuration file: %s", err)
+		return nil, err
 	}
-	fmt.Printf("Created RCON configuration file '%s' in '%s' directory.\n",
-		RconConfigurationFilename, ConfigurationDirectory)
-	return nil
+	if password == "" && NonInteractive {
+		return nil, errMissingPreset("ZeroMQ QL stats password",
+			&p.StatsPasswordFile)
+	}
+	srvcfg.QlZmqStatsPassword = password
+	validPassword = password != ""
+	for !validPassword {
+
+		fmt.Print("Enter your ZeroMQ QL stats password: ")
+		password, err := getPassword(reader)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			srvcfg.QlZmqStatsPassword = password
+			validPassword = true
+		}
+	}
+	return srvcfg, nil
 }
 
 func CreateWebConfig() error {
-	reader := bufio.NewReader(os.Stdin)
+	if err := checkStdinPasswords(); err != nil {
+		return err
+	}
+	reader := stdin
+	p := WebPreset
 	webcfg := &webConfig{
-		WebMaxMessageSize: defaultWebMaxMessageSize,
-		WebPongTimeout:    defaultWebPongTimeout,
-		WebSendTimeout:    defaultWebSendTimeout,
+		Version:               webConfigVersion,
+		WebMaxMessageSize:     defaultWebMaxMessageSize,
+		WebPongTimeout:        defaultWebPongTimeout,
+		WebSendTimeout:        defaultWebSendTimeout,
+		WebRolePermissions:    defaultWebRolePermissions(),
+		WebAuditMaxSize:       defaultWebAuditMaxSize,
+		WebAuditMaxFiles:      defaultWebAuditMaxFiles,
+		WebSessionLifetime:    defaultWebSessionLifetime,
+		WebSessionIdleTimeout: defaultWebSessionIdleTimeout,
+		WebLoginMaxAttempts:   defaultWebLoginMaxAttempts,
+		WebLoginMaxPerAddress: defaultWebLoginMaxPerAddress,
+		WebLoginDelay:         defaultWebLoginDelay,
+		WebLoginLockout:       defaultWebLoginLockout,
+		WebShutdownTimeout:    defaultWebShutdownTimeout,
+	}
+	if p.MaxMessageSize != 0 {
+		webcfg.WebMaxMessageSize = int64(p.MaxMessageSize)
+	}
+	if p.PongTimeout != 0 {
+		webcfg.WebPongTimeout = p.PongTimeout
+	}
+	if p.SendTimeout != 0 {
+		webcfg.WebSendTimeout = p.SendTimeout
+	}
+	if p.Port != 0 {
+		if err := checkPresetPort("web interface port", p.Port); err != nil {
+			return err
+		}
+		webcfg.WebServerPort = p.Port
+	} else if NonInteractive {
+		return errMissingPreset("Web interface port", &p.Port)
 	}
-	validPort := false
+	validPort := webcfg.WebServerPort != 0
 	for !validPort {
 		fmt.Print("Enter the port to use for the web interface: ")
 		port, err := getPort(reader)
@@ -174,8 +539,15 @@ func CreateWebConfig() error {
 			validPort = true
 		}
 	}
-	validUser := false
-	var user string
+	err := configureWebTLS(reader, webcfg, p)
+	if err != nil {
+		return err
+	}
+	user := p.AdminUser
+	if user == "" && NonInteractive {
+		return errMissingPreset("Web admin user name", &p.AdminUser)
+	}
+	validUser := user != ""
 	for !validUser {
 		fmt.Print("Enter the admin user name to use for the web interface: ")
 		u, err := getWebUser(reader)
@@ -186,8 +558,20 @@ func CreateWebConfig() error {
 			validUser = true
 		}
 	}
-	validPassword := false
 	var pass []byte
+	password, err := presetPassword(p.AdminPassword, p.AdminPasswordFile)
+	if err != nil {
+		return err
+	}
+	if password != "" {
+		pass, err = generateBcryptPassword(password)
+		if err != nil {
+			return err
+		}
+	} else if NonInteractive {
+		return errMissingPreset("Web admin password", &p.AdminPasswordFile)
+	}
+	validPassword := pass != nil
 	for !validPassword {
 
 		fmt.Print("Enter the admin password to use for the web interface: ")
@@ -205,11 +589,16 @@ func CreateWebConfig() error {
 		}
 	}
 
-	err := createWebUser(user, pass)
+	err = createWebUser(user, pass)
 	if err != nil {
 		return fmt.Errorf("Unable to create web user file: %s", err)
 	}
 
+	_, err = GenerateCookieKey()
+	if err != nil {
+		return err
+	}
+
 	err = writeConfigFile(webcfg)
 	if err != nil {
 		return fmt.Errorf("Unable to create web configuration file: %s", err)
@@ -220,131 +609,246 @@ func CreateWebConfig() error {
 	return nil
 }
 
-func VerifyWebUserFile() error {
-	fpath := path.Join(ConfigurationDirectory, WebUserFilename)
-	backend, err := httpauth.NewGobFileAuthBackend(fpath)
-	// currently noop for gob
-	if err != nil {
-		return err
+func configureWebTLS(reader *bufio.Reader, webcfg *webConfig,
+	p *WebPresets) error {
+	presetTLS := p.TLSSelfSignedHost != "" || p.TLSCertFile != "" ||
+		p.TLSKeyFile != ""
+	if !presetTLS {
+		if p.HTTPRedirectPort != 0 {
+			return errors.New("An HTTP redirect port needs a TLS certificate.")
+		}
+		if NonInteractive {
+			return nil
+		}
+		useTLS, err := askYesNo(reader,
+			"Serve the web interface over HTTPS? (y/n): ")
+		if err != nil || !useTLS {
+			return err
+		}
 	}
-	defer backend.Close()
-	_, err = backend.Users()
-	if err != nil {
+	var selfSigned bool
+	var err error
+	if p.TLSSelfSignedHost != "" {
+		selfSigned = true
+	} else if p.TLSCertFile == "" || p.TLSKeyFile == "" {
+		if NonInteractive {
+			return errors.New("Both a TLS certificate and key file are required.")
+		}
+		if !presetTLS {
+			selfSigned, err = askYesNo(reader,
+				"Generate a self-signed certificate for LAN use? (y/n): ")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if selfSigned {
+		host := p.TLSSelfSignedHost
+		validHost := host != ""
+		for !validHost {
+			fmt.Print("Enter the host name or IP address used to reach the web interface: ")
+			h, err := getRconHostname(reader)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				host = h
+				validHost = true
+			}
+		}
+		certpath, keypath, err := generateSelfSignedCert([]string{host})
+		if err != nil {
+			return fmt.Errorf("Unable to generate self-signed certificate: %s",
+				err)
+		}
+		fmt.Printf("Created self-signed certificate '%s' and key '%s'.\n",
+			certpath, keypath)
+		webcfg.WebTLSCertFile = certpath
+		webcfg.WebTLSKeyFile = keypath
+	} else {
+		if p.TLSCertFile != "" {
+			if err := checkPresetFile(p.TLSCertFile); err != nil {
+				return err
+			}
+			webcfg.WebTLSCertFile = p.TLSCertFile
+		} else {
+			webcfg.WebTLSCertFile = askFilePath(reader,
+				"Enter the path to the TLS certificate (PEM) file: ")
+		}
+		if p.TLSKeyFile != "" {
+			if err := checkPresetFile(p.TLSKeyFile); err != nil {
+				return err
+			}
+			webcfg.WebTLSKeyFile = p.TLSKeyFile
+		} else {
+			webcfg.WebTLSKeyFile = askFilePath(reader,
+				"Enter the path to the TLS private key (PEM) file: ")
+		}
+	}
+	if p.HTTPRedirectPort != 0 {
+		if err := checkPresetPort("HTTP redirect port",
+			p.HTTPRedirectPort); err != nil {
+			return err
+		}
+		if p.HTTPRedirectPort == webcfg.WebServerPort {
+			return errors.New("The redirect port must differ from the web interface port.")
+		}
+		webcfg.WebHTTPRedirectPort = p.HTTPRedirectPort
+		return nil
+	}
+	if NonInteractive {
+		return nil
+	}
+	redirect, err := askYesNo(reader,
+		"Redirect plain HTTP requests on another port to HTTPS? (y/n): ")
+	if err != nil || !redirect {
 		return err
 	}
+	validPort := false
+	for !validPort {
+		fmt.Print("Enter the port to redirect plain HTTP requests from: ")
+		port, err := getPort(reader)
+		if err != nil {
+			fmt.Println(err)
+		} else if port == webcfg.WebServerPort {
+			fmt.Println("The redirect port must differ from the web interface port.")
+		} else {
+			webcfg.WebHTTPRedirectPort = port
+			validPort = true
+		}
+	}
 	return nil
 }
 
-func createWebUser(username string, pass []byte) error {
-	fpath := path.Join(ConfigurationDirectory, WebUserFilename)
-	webuserfile, err := os.Create(fpath)
-	if err != nil {
-		return err
+func askYesNo(reader *bufio.Reader, prompt string) (bool, error) {
+	for {
+		fmt.Print(prompt)
+		yes, err := getYesNo(reader)
+		if err == nil {
+			return yes, nil
+		}
+		fmt.Println(err)
+		if err != errInvalidYesNo {
+			return false, err
+		}
 	}
-	defer webuserfile.Close()
-	webuserfile.Sync()
+}
 
-	backend, err := httpauth.NewGobFileAuthBackend(fpath)
-	if err != nil {
-		return err
-	}
-	defer backend.Close() // currently noop for gob
-	newuser := httpauth.UserData{
-		Username: username,
-		Email:    fmt.Sprintf("%s@localhost", username),
-		Hash:     pass,
-		Role:     "admin",
-	}
-	err = backend.SaveUser(newuser)
-	if err != nil {
-		return err
+func askFilePath(reader *bufio.Reader, prompt string) string {
+	for {
+		fmt.Print(prompt)
+		fpath, err := getFilePath(reader)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			return fpath
+		}
 	}
-	return nil
 }
 
-func createConfigDirectory() error {
-	err := os.Mkdir(ConfigurationDirectory, 0777)
-	if err != nil {
+func VerifyWebUserFile() error {
+	fpath := FilePath(WebUserFilename)
+	if _, err := os.Stat(fpath); err != nil {
 		return err
 	}
+	_, err := WebUsers.Users()
+	return err
+}
 
-	return nil
-
+// Add the admin user, or replace an existing user of the same name. Other
+// users are kept.
+func createWebUser(username string, pass []byte) error {
+	return WebUsers.SaveUser(httpauth.UserData{
+		Username: username,
+		Email:    fmt.Sprintf("%s@localhost", username),
+		Hash:     pass,
+		Role:     "admin",
+	})
 }
 
 func writeConfigFile(cfgfiletype interface{}) error {
-	err := createConfigDirectory()
-	if err != nil {
-		if !os.IsExist(err) {
-			return fmt.Errorf("Unable to create '%s' directory: %s",
-				ConfigurationDirectory, err)
-		}
-	}
-	var cfgb []byte
-	var cmsg string
-
+	var cmsg, fn string
+	var perm os.FileMode
 	switch cfgfiletype := cfgfiletype.(type) {
 	default:
 		return fmt.Errorf("Unexpected config file type %T\n", cfgfiletype)
 	case *rconConfig:
-		cmsg = "RCON"
-		cfgb, err = json.Marshal(cfgfiletype)
-		if err != nil {
-			return fmt.Errorf("Error encoding %s configuration: %s", err, cmsg)
-		}
+		// holds the QL passwords
+		cmsg, fn, perm = "RCON", RconConfigurationFilename, 0600
 	case *webConfig:
-		cmsg = "web"
-		cfgb, err = json.Marshal(cfgfiletype)
-		if err != nil {
-			return fmt.Errorf("Error encoding %s configuration: %s", err, cmsg)
-		}
+		cmsg, fn, perm = "web", WebConfigurationFilename, 0644
 	}
-
-	err = os.Chdir(ConfigurationDirectory)
+	cfgb, err := json.Marshal(cfgfiletype)
 	if err != nil {
-		return fmt.Errorf("Unable to change to configuration directory '%s': %s",
-			ConfigurationDirectory, err)
+		return fmt.Errorf("Error encoding %s configuration: %s", cmsg, err)
 	}
+	return writeConfigDirFile(fn, cfgb, perm)
+}
 
-	var cfgfile *os.File
-	var fn string
-	if cmsg == "RCON" {
-		fn = RconConfigurationFilename
-	} else if cmsg == "web" {
-		fn = WebConfigurationFilename
+func getRconHostname(r *bufio.Reader) (string, error) {
+	hostname, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("Unable to read hostname: %s", err)
+	}
+	if hostname == newline {
+		return "", errors.New("Hostname was not specified.")
 	}
+	return strings.Trim(hostname, newline), nil
+}
 
-	cfgfile, err = os.Create(fn)
+func getServerId(r *bufio.Reader) (string, error) {
+	id, err := r.ReadString('\n')
 	if err != nil {
-		return fmt.Errorf("Unable to create %s configuration file '%s': %s",
-			cmsg, fn, err)
+		return "", fmt.Errorf("Unable to read server name: %s", err)
 	}
-	defer cfgfile.Close()
-	cfgfile.Sync()
+	id = strings.Trim(id, newline)
+	if id == "" {
+		return "", errors.New("Server name was not specified.")
+	}
+	return id, validateServerId(id)
+}
 
-	writer := bufio.NewWriter(cfgfile)
-	_, err = writer.Write(cfgb)
-	writer.Flush()
-	if err != nil {
-		return fmt.Errorf("Unable to write %s configuration file '%s' to '%s' directory: %s",
-			cmsg, fn, ConfigurationDirectory, err)
+// Server names appear in URL paths, so they are kept to characters that are
+// safe there
+func validateServerId(id string) error {
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return errors.New("Server name can only contain letters, digits, '-', '_' and '.'.")
+		}
 	}
-	err = os.Chdir("..")
-	if err != nil {
-		return fmt.Errorf("Unable to change directory: %s", err)
+	if id == "." || id == ".." {
+		return errors.New("Server name cannot be '.' or '..'.")
 	}
 	return nil
 }
 
-func getRconHostname(r *bufio.Reader) (string, error) {
-	hostname, err := r.ReadString('\n')
+func getYesNo(r *bufio.Reader) (bool, error) {
+	answer, err := r.ReadString('\n')
 	if err != nil {
-		return "", fmt.Errorf("Unable to read hostname: %s", err)
+		return false, fmt.Errorf("Unable to read answer: %s", err)
 	}
-	if hostname == newline {
-		return "", errors.New("Hostname was not specified.")
+	switch strings.ToLower(strings.Trim(answer, newline)) {
+	case "y", "yes":
+		return true, nil
+	case "n", "no":
+		return false, nil
 	}
-	return strings.Trim(hostname, newline), nil
+	return false, errInvalidYesNo
+}
+
+func getFilePath(r *bufio.Reader) (string, error) {
+	fpath, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("Unable to read file path: %s", err)
+	}
+	fpath = strings.Trim(fpath, newline)
+	if fpath == "" {
+		return "", errors.New("File path was not specified.")
+	}
+	if _, err := os.Stat(fpath); err != nil {
+		return "", fmt.Errorf("Unable to read '%s': %s", fpath, err)
+	}
+	return fpath, nil
 }
 
 func getPassword(r *bufio.Reader) (string, error) {
@@ -0,0 +1,125 @@
+// files.go - Locating the configuration directory and writing files in it.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const (
+	// Relative to the working directory; used when it already exists so
+	// that installs from before the directory was configurable keep working
+	legacyConfigurationDirectory = "conf"
+	ConfigurationDirectoryEnv    = envPrefix + "CONFDIR"
+)
+
+var ConfigurationDirectory = legacyConfigurationDirectory
+
+// Files that hold passwords, keys or tokens
+var secretFiles = []string{
+	RconConfigurationFilename,
+	WebUserFilename,
+	WebCookieKeyFilename,
+	WebTokenFilename,
+	WebTLSKeyFilename,
+}
+
+// Choose the configuration directory: dir if given (--confdir), then
+// WEBQLRC_CONFDIR, then ./conf if it exists, then the user's configuration
+// directory (e.g. $XDG_CONFIG_HOME/webqlrc).
+func SetConfigurationDirectory(dir string) {
+	if dir == "" {
+		dir = os.Getenv(ConfigurationDirectoryEnv)
+	}
+	if dir == "" {
+		dir = defaultConfigurationDirectory()
+	}
+	ConfigurationDirectory = dir
+}
+
+func defaultConfigurationDirectory() string {
+	fi, err := os.Stat(legacyConfigurationDirectory)
+	if err == nil && fi.IsDir() {
+		return legacyConfigurationDirectory
+	}
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return legacyConfigurationDirectory
+	}
+	return filepath.Join(base, "webqlrc")
+}
+
+// Path of a file in the configuration directory
+func FilePath(name string) string {
+	return filepath.Join(ConfigurationDirectory, name)
+}
+
+func createConfigDirectory() error {
+	err := os.MkdirAll(ConfigurationDirectory, 0700)
+	if err != nil {
+		return fmt.Errorf("Unable to create '%s' directory: %s",
+			ConfigurationDirectory, err)
+	}
+	return nil
+}
+
+// Write a file in the configuration directory by writing a temporary file
+// next to it and renaming it into place, so readers never see a partially
+// written file.
+func writeConfigDirFile(name string, contents []byte, perm os.FileMode) error {
+	if err := createConfigDirectory(); err != nil {
+		return err
+	}
+	fpath := FilePath(name)
+	tmp, err := ioutil.TempFile(ConfigurationDirectory, "."+name+".tmp")
+	if err != nil {
+		return fmt.Errorf("Unable to create temporary file for '%s': %s",
+			fpath, err)
+	}
+	_, err = tmp.Write(contents)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fpath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Unable to write '%s': %s", fpath, err)
+	}
+	return nil
+}
+
+// Returns a warning for each secret file in the configuration directory that
+// other users can read, and for the directory itself if they can write to it.
+func CheckPermissions() []string {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	var warnings []string
+	if fi, err := os.Stat(ConfigurationDirectory); err == nil &&
+		fi.Mode().Perm()&0022 != 0 {
+		warnings = append(warnings, fmt.Sprintf(
+			"Configuration directory '%s' is writable by other users (mode %04o)",
+			ConfigurationDirectory, fi.Mode().Perm()))
+	}
+	for _, name := range secretFiles {
+		fi, err := os.Stat(FilePath(name))
+		if err != nil || fi.Mode().Perm()&0077 == 0 {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf(
+			"'%s' is readable by other users (mode %04o); run: chmod 600 %s",
+			FilePath(name), fi.Mode().Perm(), FilePath(name)))
+	}
+	return warnings
+}
@@ -0,0 +1,48 @@
+// key.go - Cookie encryption key generation and storage.
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	WebCookieKeyFilename = "web.key"
+	cookieKeyLength      = 64
+)
+
+// Generate a new random cookie key and store it in the key file, replacing
+// any existing key. Every session signed with the old key becomes invalid.
+func GenerateCookieKey() ([]byte, error) {
+	key := make([]byte, cookieKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("Unable to generate cookie key: %s", err)
+	}
+	err := writeConfigDirFile(WebCookieKeyFilename,
+		[]byte(hex.EncodeToString(key)), 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to write cookie key file: %s", err)
+	}
+	return key, nil
+}
+
+// Read the cookie key. The returned error satisfies os.IsNotExist if no key
+// has been generated yet.
+func ReadCookieKey() ([]byte, error) {
+	fpath := FilePath(WebCookieKeyFilename)
+	contents, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cookie key file '%s': %s", fpath, err)
+	}
+	if len(key) < 32 {
+		return nil, fmt.Errorf("Cookie key in '%s' is too short", fpath)
+	}
+	return key, nil
+}
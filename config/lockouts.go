@@ -0,0 +1,281 @@
+// lockouts.go - Failed web login tracking, shared by the web server and the
+// lockout command.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WebLockoutFilename = "web.lockouts"
+	loginUserPrefix    = "user:"
+	loginAddressPrefix = "address:"
+	// Longer delays than 2^maxDelayShift times the base delay are capped to
+	// the lockout anyway
+	maxDelayShift = 20
+)
+
+// Failed logins for a user name or an address
+type LoginFailures struct {
+	Count       int
+	Last        time.Time
+	LockedUntil time.Time
+}
+
+type LoginLimits struct {
+	MaxAttempts           int
+	MaxAttemptsPerAddress int
+	// Doubled after every failed attempt
+	Delay   time.Duration
+	Lockout time.Duration
+}
+
+var lockoutMutex sync.Mutex
+
+func (wc *webConfig) LoginLimits() *LoginLimits {
+	return &LoginLimits{
+		MaxAttempts:           wc.WebLoginMaxAttempts,
+		MaxAttemptsPerAddress: wc.WebLoginMaxPerAddress,
+		Delay:                 time.Duration(wc.WebLoginDelay) * time.Second,
+		Lockout:               time.Duration(wc.WebLoginLockout) * time.Second,
+	}
+}
+
+func (l *LoginLimits) maxAttempts(key string) int {
+	if strings.HasPrefix(key, loginAddressPrefix) {
+		return l.MaxAttemptsPerAddress
+	}
+	return l.MaxAttempts
+}
+
+// Failures are forgotten once the lockout time has passed since the last one
+func (l *LoginLimits) expired(f *LoginFailures, now time.Time) bool {
+	return now.After(f.Last.Add(l.Lockout)) && now.After(f.LockedUntil)
+}
+
+// How long after the last failure the next attempt has to wait
+func (l *LoginLimits) delay(f *LoginFailures) time.Duration {
+	shift := uint(f.Count - 1)
+	if shift > maxDelayShift {
+		shift = maxDelayShift
+	}
+	d := l.Delay << shift
+	if d > l.Lockout {
+		d = l.Lockout
+	}
+	return d
+}
+
+// The keys failed logins are tracked under
+func LoginKeys(username, address string) []string {
+	return []string{loginUserPrefix + username, loginAddressPrefix + address}
+}
+
+// Describes a key, e.g. "user bob" or "address 192.0.2.1"
+func DescribeLoginKey(key string) string {
+	return strings.Replace(key, ":", " ", 1)
+}
+
+func readLockouts() (map[string]*LoginFailures, error) {
+	failures := make(map[string]*LoginFailures)
+	fpath := FilePath(WebLockoutFilename)
+	contents, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return failures, nil
+		}
+		return nil, fmt.Errorf("Unable to read web lockout file '%s': %s",
+			fpath, err)
+	}
+	if err := json.Unmarshal(contents, &failures); err != nil {
+		return nil, fmt.Errorf("Invalid web lockout file '%s': %s", fpath, err)
+	}
+	return failures, nil
+}
+
+func writeLockouts(failures map[string]*LoginFailures) error {
+	contents, err := json.Marshal(failures)
+	if err != nil {
+		return fmt.Errorf("Error encoding web lockouts: %s", err)
+	}
+	return writeConfigDirFile(WebLockoutFilename, contents, 0600)
+}
+
+// How long until another login attempt is allowed for all of keys
+func (l *LoginLimits) wait(failures map[string]*LoginFailures, keys []string,
+	now time.Time) time.Duration {
+	var wait time.Duration
+	locked := false
+	for _, key := range keys {
+		f, ok := failures[key]
+		if !ok || l.expired(f, now) {
+			continue
+		}
+		if now.Before(f.LockedUntil) {
+			if w := f.LockedUntil.Sub(now); !locked || w > wait {
+				wait = w
+			}
+			locked = true
+			continue
+		}
+		if locked {
+			continue
+		}
+		if w := f.Last.Add(l.delay(f)).Sub(now); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// Count a login attempt for keys at now, unless it has to wait. Returns the
+// wait, or the keys the attempt locked out.
+func (l *LoginLimits) startAttempt(failures map[string]*LoginFailures,
+	keys []string, now time.Time) (time.Duration, []string) {
+	if wait := l.wait(failures, keys, now); wait > 0 {
+		return wait, nil
+	}
+	for key, f := range failures {
+		if l.expired(f, now) {
+			delete(failures, key)
+		}
+	}
+	var locked []string
+	for _, key := range keys {
+		f, ok := failures[key]
+		if !ok {
+			f = &LoginFailures{}
+			failures[key] = f
+		}
+		f.Count++
+		f.Last = now
+		if f.Count >= l.maxAttempts(key) && !now.Before(f.LockedUntil) {
+			f.LockedUntil = now.Add(l.Lockout)
+			locked = append(locked, key)
+		}
+	}
+	return 0, locked
+}
+
+// Take back an attempt startAttempt counted. A successful one also forgets
+// the user name's earlier failures.
+func finishAttempt(failures map[string]*LoginFailures, keys, locked []string,
+	succeeded bool) {
+	for _, key := range keys {
+		f, ok := failures[key]
+		if !ok {
+			continue
+		}
+		if succeeded && strings.HasPrefix(key, loginUserPrefix) ||
+			f.Count <= 1 {
+			delete(failures, key)
+			continue
+		}
+		f.Count--
+		// Only the lockout this attempt started; one started by a concurrent
+		// attempt stays
+		for _, l := range locked {
+			if l == key {
+				f.LockedUntil = time.Time{}
+			}
+		}
+	}
+}
+
+// Check whether a login attempt for keys is allowed and, if it is, count it
+// as failed until LoginSucceeded says otherwise. Doing both at once means
+// concurrent attempts can't all get in before the first one is counted.
+// Returns how long to wait if the attempt isn't allowed, otherwise the keys
+// the attempt locked out.
+func StartLoginAttempt(keys []string, limits *LoginLimits) (time.Duration,
+	[]string, error) {
+	lockoutMutex.Lock()
+	defer lockoutMutex.Unlock()
+	failures, err := readLockouts()
+	if err != nil {
+		return 0, nil, err
+	}
+	wait, locked := limits.startAttempt(failures, keys, time.Now())
+	if wait > 0 {
+		return wait, nil, nil
+	}
+	return 0, locked, writeLockouts(failures)
+}
+
+// Undo the failure StartLoginAttempt counted once the password was right: the
+// user name's failures are forgotten, and the attempt no longer counts
+// against the address. locked is what StartLoginAttempt returned.
+func LoginSucceeded(keys, locked []string) error {
+	return finishLoginAttempt(keys, locked, true)
+}
+
+// Take back the attempt StartLoginAttempt counted, for attempts that didn't
+// check a password. Earlier failures are kept.
+func CancelLoginAttempt(keys, locked []string) error {
+	return finishLoginAttempt(keys, locked, false)
+}
+
+func finishLoginAttempt(keys, locked []string, succeeded bool) error {
+	lockoutMutex.Lock()
+	defer lockoutMutex.Unlock()
+	failures, err := readLockouts()
+	if err != nil {
+		return err
+	}
+	finishAttempt(failures, keys, locked, succeeded)
+	return writeLockouts(failures)
+}
+
+// Forget the failed logins of keys. Returns the keys that had any.
+func ClearLoginFailures(keys ...string) ([]string, error) {
+	lockoutMutex.Lock()
+	defer lockoutMutex.Unlock()
+	failures, err := readLockouts()
+	if err != nil {
+		return nil, err
+	}
+	var cleared []string
+	for _, key := range keys {
+		if _, ok := failures[key]; ok {
+			delete(failures, key)
+			cleared = append(cleared, key)
+		}
+	}
+	if len(cleared) == 0 {
+		return nil, nil
+	}
+	return cleared, writeLockouts(failures)
+}
+
+// Clear the failed logins of a user name or address ("" for all of them).
+// Returns the keys that had any.
+func ClearLockout(nameOrAddress string) ([]string, error) {
+	if nameOrAddress != "" {
+		return ClearLoginFailures(loginUserPrefix+nameOrAddress,
+			loginAddressPrefix+nameOrAddress)
+	}
+	failures, err := ListLoginFailures()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(failures))
+	for key := range failures {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return ClearLoginFailures(keys...)
+}
+
+// All recorded failed logins, including ones old enough to be ignored
+func ListLoginFailures() (map[string]*LoginFailures, error) {
+	lockoutMutex.Lock()
+	defer lockoutMutex.Unlock()
+	return readLockouts()
+}
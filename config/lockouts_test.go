@@ -0,0 +1,239 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	testLimits = &LoginLimits{
+		MaxAttempts:           3,
+		MaxAttemptsPerAddress: 5,
+		Delay:                 time.Second,
+		Lockout:               time.Minute,
+	}
+	t0 = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func TestLoginDelay(t *testing.T) {
+	tests := []struct {
+		count int
+		want  time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		// capped to the lockout
+		{7, time.Minute},
+		{1000, time.Minute},
+	}
+	for _, test := range tests {
+		got := testLimits.delay(&LoginFailures{Count: test.count})
+		if got != test.want {
+			t.Errorf("delay after %d failures = %s, want %s", test.count, got,
+				test.want)
+		}
+	}
+}
+
+// Attempts for one user name from one address, each at an offset from t0
+func TestLoginLockout(t *testing.T) {
+	failures := make(map[string]*LoginFailures)
+	keys := LoginKeys("bob", "192.0.2.1")
+	tests := []struct {
+		at     time.Duration
+		wait   time.Duration
+		locked []string
+		count  int
+	}{
+		{0, 0, nil, 1},
+		{500 * time.Millisecond, 500 * time.Millisecond, nil, 1},
+		{time.Second, 0, nil, 2},
+		{2 * time.Second, time.Second, nil, 2},
+		{3 * time.Second, 0, []string{"user:bob"}, 3},
+		// locked out for a minute from the third attempt
+		{4 * time.Second, 59 * time.Second, nil, 3},
+		{62 * time.Second, time.Second, nil, 3},
+		// expired: starts again from one
+		{63*time.Second + 1, 0, nil, 1},
+	}
+	for _, test := range tests {
+		wait, locked := testLimits.startAttempt(failures, keys,
+			t0.Add(test.at))
+		if wait != test.wait || !reflect.DeepEqual(locked, test.locked) {
+			t.Errorf("attempt at %s = %s, %v, want %s, %v", test.at, wait,
+				locked, test.wait, test.locked)
+		}
+		if f := failures["user:bob"]; f == nil || f.Count != test.count {
+			t.Errorf("after attempt at %s, failures = %+v, want count %d",
+				test.at, f, test.count)
+		}
+	}
+}
+
+// Different user names from one address are locked out by the address limit
+func TestLoginAddressLockout(t *testing.T) {
+	failures := make(map[string]*LoginFailures)
+	now := t0
+	names := []string{"a", "b", "c", "d", "e"}
+	for i, name := range names {
+		keys := LoginKeys(name, "192.0.2.1")
+		wait, locked := testLimits.startAttempt(failures, keys, now)
+		if wait > 0 {
+			now = now.Add(wait)
+			wait, locked = testLimits.startAttempt(failures, keys, now)
+		}
+		if wait != 0 {
+			t.Fatalf("attempt %d still has to wait %s", i+1, wait)
+		}
+		var want []string
+		if i == len(names)-1 {
+			want = []string{"address:192.0.2.1"}
+		}
+		if !reflect.DeepEqual(locked, want) {
+			t.Errorf("attempt %d locked %v, want %v", i+1, locked, want)
+		}
+	}
+	wait, _ := testLimits.startAttempt(failures, LoginKeys("f", "192.0.2.1"),
+		now)
+	if wait != time.Minute {
+		t.Errorf("new user name from a locked address waits %s, want %s", wait,
+			time.Minute)
+	}
+	wait, _ = testLimits.startAttempt(failures, LoginKeys("f", "192.0.2.2"),
+		now)
+	if wait != 0 {
+		t.Errorf("other address waits %s, want 0", wait)
+	}
+}
+
+func TestLoginExpiryPruning(t *testing.T) {
+	failures := map[string]*LoginFailures{
+		"user:old":     {Count: 2, Last: t0},
+		"user:locked":  {Count: 3, Last: t0, LockedUntil: t0.Add(time.Hour)},
+		"address:mine": {Count: 1, Last: t0.Add(time.Minute)},
+	}
+	testLimits.startAttempt(failures, LoginKeys("new", "192.0.2.1"),
+		t0.Add(time.Minute+time.Second))
+	for key, want := range map[string]bool{
+		"user:old":          false,
+		"user:locked":       true,
+		"address:mine":      true,
+		"user:new":          true,
+		"address:192.0.2.1": true,
+	} {
+		if _, ok := failures[key]; ok != want {
+			t.Errorf("%s kept = %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestFinishLoginAttempt(t *testing.T) {
+	until := t0.Add(time.Minute)
+	keys := LoginKeys("bob", "192.0.2.1")
+	tests := []struct {
+		name      string
+		before    map[string]*LoginFailures
+		locked    []string
+		succeeded bool
+		after     map[string]*LoginFailures
+	}{
+		{
+			name: "success forgets the user, uncounts the address",
+			before: map[string]*LoginFailures{
+				"user:bob":          {Count: 2, Last: t0},
+				"address:192.0.2.1": {Count: 4, Last: t0},
+			},
+			succeeded: true,
+			after: map[string]*LoginFailures{
+				"address:192.0.2.1": {Count: 3, Last: t0},
+			},
+		},
+		{
+			name: "success undoes the lockout it started",
+			before: map[string]*LoginFailures{
+				"user:bob":          {Count: 3, Last: t0, LockedUntil: until},
+				"address:192.0.2.1": {Count: 5, Last: t0, LockedUntil: until},
+			},
+			locked:    []string{"user:bob", "address:192.0.2.1"},
+			succeeded: true,
+			after: map[string]*LoginFailures{
+				"address:192.0.2.1": {Count: 4, Last: t0},
+			},
+		},
+		{
+			name: "success keeps a lockout started concurrently",
+			before: map[string]*LoginFailures{
+				"address:192.0.2.1": {Count: 5, Last: t0, LockedUntil: until},
+			},
+			succeeded: true,
+			after: map[string]*LoginFailures{
+				"address:192.0.2.1": {Count: 4, Last: t0, LockedUntil: until},
+			},
+		},
+		{
+			name: "success removes an address counted once",
+			before: map[string]*LoginFailures{
+				"user:bob":          {Count: 1, Last: t0},
+				"address:192.0.2.1": {Count: 1, Last: t0},
+			},
+			succeeded: true,
+			after:     map[string]*LoginFailures{},
+		},
+		{
+			name: "cancel keeps earlier failures of the user",
+			before: map[string]*LoginFailures{
+				"user:bob":          {Count: 3, Last: t0, LockedUntil: until},
+				"address:192.0.2.1": {Count: 1, Last: t0},
+			},
+			locked: []string{"user:bob"},
+			after: map[string]*LoginFailures{
+				"user:bob": {Count: 2, Last: t0},
+			},
+		},
+	}
+	for _, test := range tests {
+		finishAttempt(test.before, keys, test.locked, test.succeeded)
+		if !reflect.DeepEqual(test.before, test.after) {
+			t.Errorf("%s: got %+v, want %+v", test.name, test.before,
+				test.after)
+		}
+	}
+}
+
+func TestLoginAttemptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webqlrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetConfigurationDirectory(ConfigurationDirectory)
+	SetConfigurationDirectory(dir)
+
+	keys := LoginKeys("bob", "192.0.2.1")
+	if _, _, err := StartLoginAttempt(keys, testLimits); err != nil {
+		t.Fatal(err)
+	}
+	failures, err := ListLoginFailures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 2 || failures["user:bob"].Count != 1 {
+		t.Errorf("after one attempt: %+v", failures)
+	}
+	wait, _, err := StartLoginAttempt(keys, testLimits)
+	if err != nil || wait <= 0 {
+		t.Errorf("second attempt straight away = %s, %v, want a wait", wait,
+			err)
+	}
+	if err := LoginSucceeded(keys, nil); err != nil {
+		t.Fatal(err)
+	}
+	if failures, _ := ListLoginFailures(); len(failures) != 0 {
+		t.Errorf("after success: %+v", failures)
+	}
+}
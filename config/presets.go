@@ -0,0 +1,243 @@
+// presets.go - Configuration answers supplied by flags and the environment.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const envPrefix = "WEBQLRC_"
+
+// Answers to the RCON configuration prompts. Values left unset are asked for
+// interactively. They describe the first server; any further servers are
+// always entered interactively.
+type RconPresets struct {
+	ServerId             string
+	Host                 string
+	Port                 int
+	Password             string
+	PasswordFile         string
+	StatsHost            string
+	StatsPort            int
+	StatsPassword        string
+	StatsPasswordFile    string
+	PollTimeout          int
+	ReconnectInterval    int
+	ReconnectMaxInterval int
+	ResponseQuietPeriod  int
+	ResponseTimeout      int
+}
+
+// Answers to the web configuration prompts.
+type WebPresets struct {
+	Port              int
+	AdminUser         string
+	AdminPassword     string
+	AdminPasswordFile string
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSSelfSignedHost string
+	HTTPRedirectPort  int
+	MaxMessageSize    int
+	PongTimeout       int
+	SendTimeout       int
+}
+
+var (
+	RconPreset = &RconPresets{}
+	WebPreset  = &WebPresets{}
+	// Never prompt: optional questions take their default answer and a
+	// missing required value is an error.
+	NonInteractive bool
+)
+
+// A preset that can be given as a flag and as an environment variable
+// (envPrefix + env). Passwords have no flag so they stay out of shell
+// history; use the matching file flag instead.
+type preset struct {
+	flag  string
+	env   string
+	usage string
+	value interface{}
+}
+
+func presets() []*preset {
+	r, w := RconPreset, WebPreset
+	return []*preset{
+		{"rconid", "RCON_ID", "Short unique name for the QL server", &r.ServerId},
+		{"rconhost", "RCON_HOST", "ZeroMQ QL RCON hostname or IP address", &r.Host},
+		{"rconport", "RCON_PORT", "ZeroMQ QL RCON port", &r.Port},
+		{"", "RCON_PASSWORD", "", &r.Password},
+		{"rconpasswordfile", "RCON_PASSWORD_FILE",
+			"File to read the ZeroMQ QL RCON password from ('-' for stdin)",
+			&r.PasswordFile},
+		{"statshost", "STATS_HOST",
+			"ZeroMQ QL stats hostname, if different from the RCON host",
+			&r.StatsHost},
+		{"statsport", "STATS_PORT", "ZeroMQ QL stats port", &r.StatsPort},
+		{"", "STATS_PASSWORD", "", &r.StatsPassword},
+		{"statspasswordfile", "STATS_PASSWORD_FILE",
+			"File to read the ZeroMQ QL stats password from ('-' for stdin)",
+			&r.StatsPasswordFile},
+		{"rconpolltimeout", "RCON_POLL_TIMEOUT",
+			"RCON socket poll timeout (ms)", &r.PollTimeout},
+		{"rconreconnect", "RCON_RECONNECT_INTERVAL",
+			"Initial RCON reconnect interval (ms)", &r.ReconnectInterval},
+		{"rconreconnectmax", "RCON_RECONNECT_MAX_INTERVAL",
+			"Maximum RCON reconnect interval (ms)", &r.ReconnectMaxInterval},
+		{"rconquietperiod", "RCON_RESPONSE_QUIET_PERIOD",
+			"Quiet period that ends an RCON response (ms)",
+			&r.ResponseQuietPeriod},
+		{"rcontimeout", "RCON_RESPONSE_TIMEOUT",
+			"Time to wait for an RCON response (ms)", &r.ResponseTimeout},
+		{"webport", "WEB_PORT", "Port for the web interface", &w.Port},
+		{"webuser", "WEB_ADMIN_USER", "Web interface admin user name",
+			&w.AdminUser},
+		{"", "WEB_ADMIN_PASSWORD", "", &w.AdminPassword},
+		{"webpasswordfile", "WEB_ADMIN_PASSWORD_FILE",
+			"File to read the web admin password from ('-' for stdin)",
+			&w.AdminPasswordFile},
+		{"webtlscert", "WEB_TLS_CERT", "TLS certificate (PEM) file",
+			&w.TLSCertFile},
+		{"webtlskey", "WEB_TLS_KEY", "TLS private key (PEM) file",
+			&w.TLSKeyFile},
+		{"webtlsselfsigned", "WEB_TLS_SELFSIGNED_HOST",
+			"Generate a self-signed certificate for this host name",
+			&w.TLSSelfSignedHost},
+		{"webredirectport", "WEB_HTTP_REDIRECT_PORT",
+			"Port to redirect plain HTTP requests to HTTPS from",
+			&w.HTTPRedirectPort},
+		{"webmaxmessagesize", "WEB_MAX_MESSAGE_SIZE",
+			"Maximum websocket message size (bytes)", &w.MaxMessageSize},
+		{"webpongtimeout", "WEB_PONG_TIMEOUT",
+			"Websocket pong timeout (seconds)", &w.PongTimeout},
+		{"websendtimeout", "WEB_SEND_TIMEOUT",
+			"Websocket send timeout (seconds)", &w.SendTimeout},
+	}
+}
+
+// Register a flag for every preset that has one.
+func RegisterPresetFlags(fs *flag.FlagSet) {
+	for _, p := range presets() {
+		if p.flag == "" {
+			continue
+		}
+		switch v := p.value.(type) {
+		case *string:
+			fs.StringVar(v, p.flag, "", p.usage)
+		case *int:
+			fs.IntVar(v, p.flag, 0, p.usage)
+		}
+	}
+	fs.BoolVar(&NonInteractive, "noninteractive", false,
+		"Never prompt when generating configuration files")
+}
+
+// Fill presets not given as flags from the environment.
+func LoadPresetEnv() error {
+	for _, p := range presets() {
+		val := os.Getenv(envPrefix + p.env)
+		if val == "" {
+			continue
+		}
+		switch v := p.value.(type) {
+		case *string:
+			if *v == "" {
+				*v = val
+			}
+		case *int:
+			if *v != 0 {
+				continue
+			}
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s%s: '%s' is not a number",
+					envPrefix, p.env, val)
+			}
+			*v = n
+		}
+	}
+	if !NonInteractive {
+		yes, _ := strconv.ParseBool(os.Getenv(envPrefix + "NONINTERACTIVE"))
+		NonInteractive = yes
+	}
+	return nil
+}
+
+func errMissingPreset(what string, value interface{}) error {
+	for _, p := range presets() {
+		if p.value != value {
+			continue
+		}
+		if p.flag == "" {
+			return fmt.Errorf("%s was not specified. Set %s%s.", what,
+				envPrefix, p.env)
+		}
+		return fmt.Errorf("%s was not specified. Use --%s or set %s%s.", what,
+			p.flag, envPrefix, p.env)
+	}
+	return fmt.Errorf("%s was not specified.", what)
+}
+
+// Returns the preset password, reading it from fpath if it isn't set
+// directly. An empty result means nothing was preset.
+func presetPassword(password, fpath string) (string, error) {
+	if password != "" || fpath == "" {
+		return password, nil
+	}
+	var contents []byte
+	var err error
+	if fpath == "-" {
+		var line string
+		line, err = stdin.ReadString('\n')
+		if err != nil && line != "" {
+			err = nil
+		}
+		contents = []byte(line)
+	} else {
+		contents, err = ioutil.ReadFile(fpath)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to read password file '%s': %s", fpath,
+			err)
+	}
+	password = strings.TrimRight(string(contents), "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("Password file '%s' is empty.", fpath)
+	}
+	return password, nil
+}
+
+func checkPresetPort(what string, port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("Invalid %s %d. Port must be a number from 1-65535",
+			what, port)
+	}
+	return nil
+}
+
+func checkPresetFile(fpath string) error {
+	if _, err := os.Stat(fpath); err != nil {
+		return fmt.Errorf("Unable to read '%s': %s", fpath, err)
+	}
+	return nil
+}
+
+func checkStdinPasswords() error {
+	n := 0
+	for _, f := range []string{RconPreset.PasswordFile,
+		RconPreset.StatsPasswordFile, WebPreset.AdminPasswordFile} {
+		if f == "-" {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("Only one password can be read from stdin.")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// tokens.go - API tokens for web users.
+package config
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	WebTokenFilename = "web.tokens"
+	apiTokenLength   = 32
+)
+
+type apiToken struct {
+	Username string
+	Created  time.Time
+}
+
+var ErrUnknownToken = errors.New("Unknown API token")
+
+// Tokens are stored by the hex encoded SHA-256 of the token itself so that
+// the file can't be used to make API calls.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func readTokens() (map[string]*apiToken, error) {
+	tokens := make(map[string]*apiToken)
+	fpath := FilePath(WebTokenFilename)
+	contents, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tokens, nil
+		}
+		return nil, fmt.Errorf("Unable to read API token file '%s': %s", fpath,
+			err)
+	}
+	if err := json.Unmarshal(contents, &tokens); err != nil {
+		return nil, fmt.Errorf("Invalid API token file '%s': %s", fpath, err)
+	}
+	return tokens, nil
+}
+
+func writeTokens(tokens map[string]*apiToken) error {
+	contents, err := json.Marshal(tokens)
+	if err != nil {
+		return fmt.Errorf("Error encoding API tokens: %s", err)
+	}
+	return writeConfigDirFile(WebTokenFilename, contents, 0600)
+}
+
+// Create a new API token for a web user. The token is only ever returned
+// here; only its hash is stored.
+func CreateAPIToken(username string) (string, error) {
+	if _, err := WebUsers.User(username); err != nil {
+		return "", fmt.Errorf("No such web user '%s'", username)
+	}
+	tokens, err := readTokens()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, apiTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Unable to generate API token: %s", err)
+	}
+	token := hex.EncodeToString(b)
+	tokens[hashToken(token)] = &apiToken{Username: username, Created: time.Now()}
+	if err := writeTokens(tokens); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Returns the user name an API token belongs to.
+func LookupAPIToken(token string) (string, error) {
+	tokens, err := readTokens()
+	if err != nil {
+		return "", err
+	}
+	t, ok := tokens[hashToken(token)]
+	if !ok {
+		return "", ErrUnknownToken
+	}
+	return t.Username, nil
+}
+
+// Revoke every API token belonging to a web user. Returns the number of
+// tokens removed.
+func DeleteAPITokens(username string) (int, error) {
+	tokens, err := readTokens()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for hash, t := range tokens {
+		if t.Username == username {
+			delete(tokens, hash)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, writeTokens(tokens)
+}
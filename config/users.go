@@ -0,0 +1,231 @@
+// users.go - Web user file management.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/apexskier/httpauth"
+)
+
+var (
+	ErrLastAdmin = errors.New("Refusing to remove the last admin user")
+	// The web user file shared by the server and the user command
+	WebUsers = &WebUserBackend{}
+)
+
+// An httpauth.AuthBackend for the web user file that re-reads the file on
+// every call, so users changed with the user command while the server is
+// running take effect immediately and are never overwritten with stale
+// copies.
+type WebUserBackend struct {
+	mutex sync.Mutex
+}
+
+func (b *WebUserBackend) open() (httpauth.GobFileAuthBackend, error) {
+	fpath := FilePath(WebUserFilename)
+	// The gob backend keeps the mode of an existing file when saving
+	if _, err := os.Stat(fpath); os.IsNotExist(err) {
+		if err := createConfigDirectory(); err != nil {
+			return httpauth.GobFileAuthBackend{}, err
+		}
+		f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return httpauth.GobFileAuthBackend{}, err
+		}
+		f.Close()
+	}
+	return httpauth.NewGobFileAuthBackend(fpath)
+}
+
+func (b *WebUserBackend) SaveUser(user httpauth.UserData) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	backend, err := b.open()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	return backend.SaveUser(user)
+}
+
+func (b *WebUserBackend) User(username string) (httpauth.UserData, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	backend, err := b.open()
+	if err != nil {
+		return httpauth.UserData{}, err
+	}
+	defer backend.Close()
+	return backend.User(username)
+}
+
+func (b *WebUserBackend) Users() ([]httpauth.UserData, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	backend, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+	defer backend.Close()
+	return backend.Users()
+}
+
+func (b *WebUserBackend) DeleteUser(username string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	backend, err := b.open()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	return backend.DeleteUser(username)
+}
+
+func (b *WebUserBackend) Close() {}
+
+func ValidateWebUsername(username string) error {
+	if username == "" {
+		return errors.New("User name was not specified.")
+	}
+	if strings.ContainsAny(username, " \t\r\n:") {
+		return errors.New("User name cannot contain spaces or ':'.")
+	}
+	return nil
+}
+
+func ValidateWebRole(role string) error {
+	if _, ok := WebRoles[role]; !ok {
+		roles := make([]string, 0, len(WebRoles))
+		for r := range WebRoles {
+			roles = append(roles, r)
+		}
+		sort.Strings(roles)
+		return fmt.Errorf("Unknown role '%s'. Roles are: %s", role,
+			strings.Join(roles, ", "))
+	}
+	return nil
+}
+
+// Web users sorted by name
+func ListWebUsers() ([]httpauth.UserData, error) {
+	users, err := WebUsers.Users()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
+func AddWebUser(username, password, role string) error {
+	if err := ValidateWebUsername(username); err != nil {
+		return err
+	}
+	if err := ValidateWebRole(role); err != nil {
+		return err
+	}
+	if password == "" {
+		return errors.New("Password was not specified.")
+	}
+	if _, err := WebUsers.User(username); err == nil {
+		return fmt.Errorf("User '%s' already exists", username)
+	}
+	hash, err := generateBcryptPassword(password)
+	if err != nil {
+		return err
+	}
+	return WebUsers.SaveUser(httpauth.UserData{
+		Username: username,
+		Email:    fmt.Sprintf("%s@localhost", username),
+		Hash:     hash,
+		Role:     role,
+	})
+}
+
+// Delete a web user, revoking their API tokens
+func DeleteWebUser(username string) error {
+	user, err := WebUsers.User(username)
+	if err != nil {
+		return fmt.Errorf("No such web user '%s'", username)
+	}
+	if user.Role == "admin" {
+		if err := CheckOtherAdmins(username); err != nil {
+			return err
+		}
+	}
+	if err := WebUsers.DeleteUser(username); err != nil {
+		return err
+	}
+	return ForgetWebUser(username)
+}
+
+func SetWebUserPassword(username, password string) error {
+	user, err := WebUsers.User(username)
+	if err != nil {
+		return fmt.Errorf("No such web user '%s'", username)
+	}
+	if password == "" {
+		return errors.New("Password was not specified.")
+	}
+	user.Hash, err = generateBcryptPassword(password)
+	if err != nil {
+		return err
+	}
+	return WebUsers.SaveUser(user)
+}
+
+func SetWebUserRole(username, role string) error {
+	if err := ValidateWebRole(role); err != nil {
+		return err
+	}
+	user, err := WebUsers.User(username)
+	if err != nil {
+		return fmt.Errorf("No such web user '%s'", username)
+	}
+	if user.Role == "admin" && role != "admin" {
+		if err := CheckOtherAdmins(username); err != nil {
+			return err
+		}
+	}
+	user.Role = role
+	return WebUsers.SaveUser(user)
+}
+
+// Returns ErrLastAdmin unless an enabled admin other than username exists
+func CheckOtherAdmins(username string) error {
+	users, err := WebUsers.Users()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.Role != "admin" || u.Username == username {
+			continue
+		}
+		state, err := GetWebUserState(u.Username)
+		if err != nil {
+			return err
+		}
+		if !state.Disabled {
+			return nil
+		}
+	}
+	return ErrLastAdmin
+}
+
+// Read a password from fpath ('-' for stdin), or ask for it if fpath is empty
+func ReadPassword(fpath, prompt string) (string, error) {
+	if fpath != "" {
+		return presetPassword("", fpath)
+	}
+	if NonInteractive {
+		return "", errors.New("Password was not specified.")
+	}
+	fmt.Print(prompt)
+	return getPassword(stdin)
+}
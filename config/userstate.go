@@ -0,0 +1,129 @@
+// userstate.go - Account state kept alongside the web user file.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const WebUserStateFilename = "web.userstate"
+
+// Per user state that httpauth has no place for
+type WebUserState struct {
+	Disabled bool `json:",omitempty"`
+	// Sessions started before this time are no longer valid
+	SessionsRevoked time.Time
+}
+
+var userStateMutex sync.Mutex
+
+func readUserStates() (map[string]*WebUserState, error) {
+	states := make(map[string]*WebUserState)
+	fpath := FilePath(WebUserStateFilename)
+	contents, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return states, nil
+		}
+		return nil, fmt.Errorf("Unable to read web user state file '%s': %s",
+			fpath, err)
+	}
+	if err := json.Unmarshal(contents, &states); err != nil {
+		return nil, fmt.Errorf("Invalid web user state file '%s': %s", fpath,
+			err)
+	}
+	return states, nil
+}
+
+func updateUserState(username string, update func(s *WebUserState)) error {
+	userStateMutex.Lock()
+	defer userStateMutex.Unlock()
+	states, err := readUserStates()
+	if err != nil {
+		return err
+	}
+	s, ok := states[username]
+	if !ok {
+		s = &WebUserState{}
+		states[username] = s
+	}
+	if update == nil {
+		delete(states, username)
+	} else {
+		update(s)
+	}
+	contents, err := json.Marshal(states)
+	if err != nil {
+		return fmt.Errorf("Error encoding web user state: %s", err)
+	}
+	return writeConfigDirFile(WebUserStateFilename, contents, 0600)
+}
+
+// Returns the user's state; users without any are enabled with no revoked
+// sessions.
+func GetWebUserState(username string) (*WebUserState, error) {
+	userStateMutex.Lock()
+	defer userStateMutex.Unlock()
+	states, err := readUserStates()
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := states[username]; ok {
+		return s, nil
+	}
+	return &WebUserState{}, nil
+}
+
+// Disabling a user also ends their sessions.
+func SetWebUserDisabled(username string, disabled bool) error {
+	user, err := WebUsers.User(username)
+	if err != nil {
+		return fmt.Errorf("No such web user '%s'", username)
+	}
+	if disabled && user.Role == "admin" {
+		if err := CheckOtherAdmins(username); err != nil {
+			return err
+		}
+	}
+	return updateUserState(username, func(s *WebUserState) {
+		s.Disabled = disabled
+		if disabled {
+			s.SessionsRevoked = time.Now()
+		}
+	})
+}
+
+func RevokeWebUserSessions(username string) error {
+	if _, err := WebUsers.User(username); err != nil {
+		return fmt.Errorf("No such web user '%s'", username)
+	}
+	return updateUserState(username, func(s *WebUserState) {
+		s.SessionsRevoked = time.Now()
+	})
+}
+
+// End every user's sessions, e.g. once the cookie key has been rotated
+func RevokeAllWebUserSessions() error {
+	users, err := ListWebUsers()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if err := RevokeWebUserSessions(u.Username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove everything kept about a deleted user besides the user file entry
+func ForgetWebUser(username string) error {
+	if _, err := DeleteAPITokens(username); err != nil {
+		return err
+	}
+	return updateUserState(username, nil)
+}
@@ -0,0 +1,268 @@
+// validate.go - Configuration file versions, migrations, defaults and
+// validation.
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	rconConfigVersion = 1
+	webConfigVersion  = 1
+)
+
+// Upgrades from each older file version to the next, indexed by the version
+// they upgrade from.
+var rconMigrations = []func(rc *rconConfig){
+	// 0: a single server kept in top level fields
+	func(rc *rconConfig) {
+		rc.upgradeSingleServer()
+	},
+}
+
+var webMigrations = []func(wc *webConfig){
+	// 0: nothing to convert; fields added since are filled with defaults
+	func(wc *webConfig) {},
+}
+
+// A configuration file's contents
+type configFile interface {
+	migrate() (int, error)
+	applyDefaults()
+	Validate() error
+}
+
+// A problem with a single configuration field
+type FieldError struct {
+	Field   string
+	Problem string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Problem)
+}
+
+type ValidationError struct {
+	Errors []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		problems[i] = fe.Error()
+	}
+	return "Invalid configuration: " + strings.Join(problems, "; ")
+}
+
+type validator struct {
+	errors []*FieldError
+}
+
+func (v *validator) fail(field, format string, a ...interface{}) {
+	v.errors = append(v.errors, &FieldError{field, fmt.Sprintf(format, a...)})
+}
+
+func (v *validator) port(field string, port int, optional bool) {
+	if optional && port == 0 {
+		return
+	}
+	if port < 1 || port > 65535 {
+		v.fail(field, "port %d is not in the range 1-65535", port)
+	}
+}
+
+func (v *validator) positive(field string, val int64) {
+	if val <= 0 {
+		v.fail(field, "must be greater than 0, not %d", val)
+	}
+}
+
+func (v *validator) err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return &ValidationError{v.errors}
+}
+
+// Returns the version the file was upgraded from.
+func (rc *rconConfig) migrate() (int, error) {
+	from := rc.Version
+	if from > rconConfigVersion {
+		return from, fmt.Errorf("RCON configuration version %d is newer than this version of webqlrc supports (%d)",
+			from, rconConfigVersion)
+	}
+	for ; rc.Version < rconConfigVersion; rc.Version++ {
+		rconMigrations[rc.Version](rc)
+	}
+	return from, nil
+}
+
+func (wc *webConfig) migrate() (int, error) {
+	from := wc.Version
+	if from > webConfigVersion {
+		return from, fmt.Errorf("Web configuration version %d is newer than this version of webqlrc supports (%d)",
+			from, webConfigVersion)
+	}
+	for ; wc.Version < webConfigVersion; wc.Version++ {
+		webMigrations[wc.Version](wc)
+	}
+	return from, nil
+}
+
+// Fields missing from the file are read as 0
+func (rc *rconConfig) applyDefaults() {
+	if rc.QlZmqRconPollTimeout == 0 {
+		rc.QlZmqRconPollTimeout = defaultRconPollTimeOut
+	}
+	if rc.QlZmqReconnectInterval == 0 {
+		rc.QlZmqReconnectInterval = defaultRconReconnectInterval
+	}
+	if rc.QlZmqReconnectMaxInterval == 0 {
+		rc.QlZmqReconnectMaxInterval = defaultRconReconnectMaxInterval
+	}
+	if rc.QlZmqResponseQuietPeriod == 0 {
+		rc.QlZmqResponseQuietPeriod = defaultRconResponseQuietPeriod
+	}
+	if rc.QlZmqResponseTimeout == 0 {
+		rc.QlZmqResponseTimeout = defaultRconResponseTimeout
+	}
+}
+
+func (wc *webConfig) applyDefaults() {
+	if wc.WebMaxMessageSize == 0 {
+		wc.WebMaxMessageSize = defaultWebMaxMessageSize
+	}
+	if wc.WebPongTimeout == 0 {
+		wc.WebPongTimeout = defaultWebPongTimeout
+	}
+	if wc.WebSendTimeout == 0 {
+		wc.WebSendTimeout = defaultWebSendTimeout
+	}
+	if wc.WebRolePermissions == nil {
+		wc.WebRolePermissions = defaultWebRolePermissions()
+	}
+	if wc.WebAuditMaxSize == 0 {
+		wc.WebAuditMaxSize = defaultWebAuditMaxSize
+	}
+	if wc.WebAuditMaxFiles == 0 {
+		wc.WebAuditMaxFiles = defaultWebAuditMaxFiles
+	}
+	if wc.WebSessionLifetime == 0 {
+		wc.WebSessionLifetime = defaultWebSessionLifetime
+	}
+	if wc.WebSessionIdleTimeout == 0 {
+		wc.WebSessionIdleTimeout = defaultWebSessionIdleTimeout
+	}
+	if wc.WebLoginMaxAttempts == 0 {
+		wc.WebLoginMaxAttempts = defaultWebLoginMaxAttempts
+	}
+	if wc.WebLoginMaxPerAddress == 0 {
+		wc.WebLoginMaxPerAddress = defaultWebLoginMaxPerAddress
+	}
+	if wc.WebLoginDelay == 0 {
+		wc.WebLoginDelay = defaultWebLoginDelay
+	}
+	if wc.WebLoginLockout == 0 {
+		wc.WebLoginLockout = defaultWebLoginLockout
+	}
+	if wc.WebShutdownTimeout == 0 {
+		wc.WebShutdownTimeout = defaultWebShutdownTimeout
+	}
+}
+
+func (rc *rconConfig) Validate() error {
+	v := &validator{}
+	if len(rc.Servers) == 0 {
+		v.fail("Servers", "no servers are defined")
+	}
+	seen := make(map[string]bool)
+	for i, s := range rc.Servers {
+		field := fmt.Sprintf("Servers[%d]", i)
+		if s.Id == "" {
+			v.fail(field+".Id", "must not be empty")
+		} else if err := validateServerId(s.Id); err != nil {
+			v.fail(field+".Id", "%s", err)
+		} else if seen[s.Id] {
+			v.fail(field+".Id", "duplicate server id '%s'", s.Id)
+		}
+		seen[s.Id] = true
+		if strings.TrimSpace(s.QlZmqHost) == "" {
+			v.fail(field+".QlZmqHost", "must not be empty")
+		}
+		v.port(field+".QlZmqRconPort", s.QlZmqRconPort, false)
+		v.port(field+".QlZmqStatsPort", s.QlZmqStatsPort, true)
+	}
+	v.positive("QlZmqRconPollTimeout", int64(rc.QlZmqRconPollTimeout))
+	v.positive("QlZmqReconnectInterval", int64(rc.QlZmqReconnectInterval))
+	v.positive("QlZmqReconnectMaxInterval",
+		int64(rc.QlZmqReconnectMaxInterval))
+	if rc.QlZmqReconnectMaxInterval < rc.QlZmqReconnectInterval {
+		v.fail("QlZmqReconnectMaxInterval",
+			"must not be less than QlZmqReconnectInterval (%d)",
+			rc.QlZmqReconnectInterval)
+	}
+	v.positive("QlZmqResponseQuietPeriod", int64(rc.QlZmqResponseQuietPeriod))
+	v.positive("QlZmqResponseTimeout", int64(rc.QlZmqResponseTimeout))
+	return v.err()
+}
+
+func (wc *webConfig) Validate() error {
+	v := &validator{}
+	v.port("WebServerPort", wc.WebServerPort, false)
+	v.positive("WebMaxMessageSize", wc.WebMaxMessageSize)
+	// Pings are sent every 9/10 of the pong timeout
+	if wc.WebPongTimeout < 2 {
+		v.fail("WebPongTimeout", "must be at least 2 seconds, not %d",
+			wc.WebPongTimeout)
+	}
+	v.positive("WebSendTimeout", int64(wc.WebSendTimeout))
+	for role := range wc.WebRolePermissions {
+		if _, ok := WebRoles[role]; !ok {
+			v.fail("WebRolePermissions", "unknown role '%s'", role)
+		}
+	}
+	for i, origin := range wc.WebAllowedOrigins {
+		if strings.TrimSpace(origin) == "" {
+			v.fail(fmt.Sprintf("WebAllowedOrigins[%d]", i), "must not be empty")
+		}
+	}
+	if wc.WebAuditMaxSize < 0 {
+		v.fail("WebAuditMaxSize", "must not be negative")
+	}
+	if wc.WebAuditMaxFiles < 0 {
+		v.fail("WebAuditMaxFiles", "must not be negative")
+	}
+	if (wc.WebTLSCertFile == "") != (wc.WebTLSKeyFile == "") {
+		v.fail("WebTLSCertFile", "TLS needs both a certificate and a key file")
+	}
+	v.positive("WebSessionLifetime", int64(wc.WebSessionLifetime))
+	v.positive("WebSessionIdleTimeout", int64(wc.WebSessionIdleTimeout))
+	v.positive("WebLoginMaxAttempts", int64(wc.WebLoginMaxAttempts))
+	v.positive("WebLoginMaxPerAddress",
+		int64(wc.WebLoginMaxPerAddress))
+	v.positive("WebLoginDelay", int64(wc.WebLoginDelay))
+	v.positive("WebLoginLockout", int64(wc.WebLoginLockout))
+	v.positive("WebShutdownTimeout", int64(wc.WebShutdownTimeout))
+	v.port("WebHTTPRedirectPort", wc.WebHTTPRedirectPort, true)
+	if wc.WebMetricsAddress != "" {
+		if _, port, err := net.SplitHostPort(wc.WebMetricsAddress); err != nil {
+			v.fail("WebMetricsAddress", "%s", err)
+		} else if p, err := strconv.Atoi(port); err != nil {
+			v.fail("WebMetricsAddress", "invalid port '%s'", port)
+		} else {
+			v.port("WebMetricsAddress", p, false)
+		}
+	}
+	if wc.WebHTTPRedirectPort != 0 {
+		if !wc.TLSEnabled() {
+			v.fail("WebHTTPRedirectPort", "redirecting to HTTPS needs TLS")
+		}
+		if wc.WebHTTPRedirectPort == wc.WebServerPort {
+			v.fail("WebHTTPRedirectPort", "must differ from WebServerPort")
+		}
+	}
+	return v.err()
+}
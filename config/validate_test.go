@@ -0,0 +1,322 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRconMigrations(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		from int
+		want *rconConfig
+	}{
+		{
+			name: "version 0: single server",
+			file: `{"QlZmqHost": "ql.example.com", "QlZmqRconPort": 28960,
+				"QlZmqRconPassword": "secret", "QlZmqRconPollTimeout": 100}`,
+			from: 0,
+			want: &rconConfig{
+				Version: 1,
+				Servers: []*RconServerConfig{{
+					Id:                defaultRconServerId,
+					QlZmqHost:         "ql.example.com",
+					QlZmqRconPort:     28960,
+					QlZmqRconPassword: "secret",
+				}},
+				QlZmqRconPollTimeout: 100,
+			},
+		},
+		{
+			name: "version 0: servers already listed",
+			file: `{"Servers": [{"Id": "duel", "QlZmqHost": "h",
+				"QlZmqRconPort": 28960}]}`,
+			from: 0,
+			want: &rconConfig{
+				Version: 1,
+				Servers: []*RconServerConfig{{Id: "duel", QlZmqHost: "h",
+					QlZmqRconPort: 28960}},
+			},
+		},
+		{
+			name: "current version",
+			file: `{"Version": 1, "Servers": [{"Id": "duel",
+				"QlZmqHost": "h", "QlZmqRconPort": 28960}]}`,
+			from: 1,
+			want: &rconConfig{
+				Version: 1,
+				Servers: []*RconServerConfig{{Id: "duel", QlZmqHost: "h",
+					QlZmqRconPort: 28960}},
+			},
+		},
+	}
+	for _, test := range tests {
+		rc := &rconConfig{}
+		if err := json.Unmarshal([]byte(test.file), rc); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		from, err := rc.migrate()
+		if err != nil || from != test.from {
+			t.Errorf("%s: migrate() = %d, %v, want %d", test.name, from, err,
+				test.from)
+		}
+		if !reflect.DeepEqual(rc, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, rc, test.want)
+		}
+	}
+}
+
+func TestWebMigrations(t *testing.T) {
+	for _, version := range []int{0, 1} {
+		wc := &webConfig{Version: version, WebServerPort: 8080}
+		from, err := wc.migrate()
+		if err != nil || from != version {
+			t.Errorf("version %d: migrate() = %d, %v", version, from, err)
+		}
+		want := &webConfig{Version: webConfigVersion, WebServerPort: 8080}
+		if !reflect.DeepEqual(wc, want) {
+			t.Errorf("version %d: got %+v, want %+v", version, wc, want)
+		}
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	if _, err := (&rconConfig{Version: rconConfigVersion + 1}).migrate(); err == nil {
+		t.Error("newer RCON configuration version accepted")
+	}
+	if _, err := (&webConfig{Version: webConfigVersion + 1}).migrate(); err == nil {
+		t.Error("newer web configuration version accepted")
+	}
+}
+
+// Older files are upgraded in place, keeping a backup; current ones are left
+// alone
+func TestReadConfigUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webqlrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetConfigurationDirectory(ConfigurationDirectory)
+	SetConfigurationDirectory(dir)
+
+	old := `{"QlZmqHost": "h", "QlZmqRconPort": 28960}`
+	if err := ioutil.WriteFile(FilePath(RconConfigurationFilename),
+		[]byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ReadConfig(RCON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := cfg.Rcon.Server(defaultRconServerId); s == nil ||
+		cfg.Rcon.QlZmqRconPollTimeout != defaultRconPollTimeOut {
+		t.Errorf("upgraded configuration: %+v", cfg.Rcon)
+	}
+	backup, err := ioutil.ReadFile(FilePath(RconConfigurationFilename +
+		".v0.bak"))
+	if err != nil || string(backup) != old {
+		t.Errorf("backup = %q, %v, want %q", backup, err, old)
+	}
+	upgraded := &rconConfig{}
+	contents, _ := ioutil.ReadFile(FilePath(RconConfigurationFilename))
+	if err := json.Unmarshal(contents, upgraded); err != nil ||
+		upgraded.Version != rconConfigVersion {
+		t.Errorf("file not upgraded: %s", contents)
+	}
+
+	os.Remove(FilePath(RconConfigurationFilename + ".v0.bak"))
+	if _, err := ReadConfig(RCON); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(FilePath(RconConfigurationFilename +
+		".v1.bak")); !os.IsNotExist(err) {
+		t.Error("current version file was backed up")
+	}
+}
+
+func validRconConfig() *rconConfig {
+	rc := &rconConfig{
+		Version: rconConfigVersion,
+		Servers: []*RconServerConfig{
+			{Id: "duel", QlZmqHost: "h", QlZmqRconPort: 28960},
+			{Id: "ca", QlZmqHost: "h", QlZmqRconPort: 28961,
+				QlZmqStatsPort: 27961},
+		},
+	}
+	rc.applyDefaults()
+	return rc
+}
+
+func validWebConfig() *webConfig {
+	wc := &webConfig{Version: webConfigVersion, WebServerPort: 8080}
+	wc.applyDefaults()
+	return wc
+}
+
+func invalidFields(err error) []string {
+	if err == nil {
+		return nil
+	}
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		return []string{err.Error()}
+	}
+	var fields []string
+	for _, fe := range ve.Errors {
+		fields = append(fields, fe.Field)
+	}
+	return fields
+}
+
+func TestValidateRcon(t *testing.T) {
+	tests := []struct {
+		field  string
+		change func(rc *rconConfig)
+	}{
+		{"", func(rc *rconConfig) {}},
+		{"Servers", func(rc *rconConfig) { rc.Servers = nil }},
+		{"Servers[0].Id", func(rc *rconConfig) { rc.Servers[0].Id = "" }},
+		{"Servers[0].Id", func(rc *rconConfig) { rc.Servers[0].Id = "a b" }},
+		{"Servers[0].Id", func(rc *rconConfig) { rc.Servers[0].Id = "a@b" }},
+		{"Servers[0].Id", func(rc *rconConfig) { rc.Servers[0].Id = "a/b" }},
+		{"Servers[0].Id", func(rc *rconConfig) { rc.Servers[0].Id = "a?b" }},
+		{"Servers[0].Id", func(rc *rconConfig) { rc.Servers[0].Id = "a#b" }},
+		{"Servers[0].Id", func(rc *rconConfig) { rc.Servers[0].Id = "a%2Fb" }},
+		{"Servers[0].Id", func(rc *rconConfig) { rc.Servers[0].Id = ".." }},
+		{"Servers[0].Id", func(rc *rconConfig) { rc.Servers[0].Id = "ünï" }},
+		{"", func(rc *rconConfig) { rc.Servers[0].Id = "ca-2_v1.0" }},
+		{"Servers[1].Id", func(rc *rconConfig) { rc.Servers[1].Id = "duel" }},
+		{"Servers[0].QlZmqHost", func(rc *rconConfig) {
+			rc.Servers[0].QlZmqHost = " "
+		}},
+		{"Servers[0].QlZmqRconPort", func(rc *rconConfig) {
+			rc.Servers[0].QlZmqRconPort = 0
+		}},
+		{"Servers[0].QlZmqRconPort", func(rc *rconConfig) {
+			rc.Servers[0].QlZmqRconPort = 65536
+		}},
+		{"Servers[1].QlZmqStatsPort", func(rc *rconConfig) {
+			rc.Servers[1].QlZmqStatsPort = -1
+		}},
+		{"QlZmqRconPollTimeout", func(rc *rconConfig) {
+			rc.QlZmqRconPollTimeout = -1
+		}},
+		{"QlZmqReconnectInterval", func(rc *rconConfig) {
+			rc.QlZmqReconnectInterval = -1
+		}},
+		{"QlZmqReconnectMaxInterval", func(rc *rconConfig) {
+			rc.QlZmqReconnectMaxInterval = rc.QlZmqReconnectInterval - 1
+		}},
+		{"QlZmqResponseQuietPeriod", func(rc *rconConfig) {
+			rc.QlZmqResponseQuietPeriod = -1
+		}},
+		{"QlZmqResponseTimeout", func(rc *rconConfig) {
+			rc.QlZmqResponseTimeout = -1
+		}},
+	}
+	for _, test := range tests {
+		rc := validRconConfig()
+		test.change(rc)
+		var want []string
+		if test.field != "" {
+			want = []string{test.field}
+		}
+		if got := invalidFields(rc.Validate()); !reflect.DeepEqual(got, want) {
+			t.Errorf("invalid fields = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestValidateWeb(t *testing.T) {
+	tests := []struct {
+		field  string
+		change func(wc *webConfig)
+	}{
+		{"", func(wc *webConfig) {}},
+		{"WebServerPort", func(wc *webConfig) { wc.WebServerPort = 0 }},
+		{"WebMaxMessageSize", func(wc *webConfig) { wc.WebMaxMessageSize = -1 }},
+		{"WebPongTimeout", func(wc *webConfig) { wc.WebPongTimeout = 1 }},
+		{"WebSendTimeout", func(wc *webConfig) { wc.WebSendTimeout = -1 }},
+		{"WebRolePermissions", func(wc *webConfig) {
+			wc.WebRolePermissions["owner"] = &rolePermissions{}
+		}},
+		{"WebAllowedOrigins[1]", func(wc *webConfig) {
+			wc.WebAllowedOrigins = []string{"https://ql.example.com", " "}
+		}},
+		{"WebAuditMaxSize", func(wc *webConfig) { wc.WebAuditMaxSize = -1 }},
+		{"WebAuditMaxFiles", func(wc *webConfig) { wc.WebAuditMaxFiles = -1 }},
+		{"WebTLSCertFile", func(wc *webConfig) { wc.WebTLSCertFile = "cert" }},
+		{"WebTLSCertFile", func(wc *webConfig) { wc.WebTLSKeyFile = "key" }},
+		{"WebSessionLifetime", func(wc *webConfig) {
+			wc.WebSessionLifetime = -1
+		}},
+		{"WebSessionIdleTimeout", func(wc *webConfig) {
+			wc.WebSessionIdleTimeout = -1
+		}},
+		{"WebLoginMaxAttempts", func(wc *webConfig) {
+			wc.WebLoginMaxAttempts = -1
+		}},
+		{"WebLoginMaxPerAddress", func(wc *webConfig) {
+			wc.WebLoginMaxPerAddress = -1
+		}},
+		{"WebLoginDelay", func(wc *webConfig) { wc.WebLoginDelay = -1 }},
+		{"WebLoginLockout", func(wc *webConfig) { wc.WebLoginLockout = -1 }},
+		{"WebShutdownTimeout", func(wc *webConfig) {
+			wc.WebShutdownTimeout = -1
+		}},
+		{"WebMetricsAddress", func(wc *webConfig) {
+			wc.WebMetricsAddress = "localhost"
+		}},
+		{"WebMetricsAddress", func(wc *webConfig) {
+			wc.WebMetricsAddress = "localhost:metrics"
+		}},
+		{"WebMetricsAddress", func(wc *webConfig) {
+			wc.WebMetricsAddress = "localhost:0"
+		}},
+		{"WebHTTPRedirectPort", func(wc *webConfig) {
+			wc.WebHTTPRedirectPort = 65536
+			wc.WebTLSCertFile, wc.WebTLSKeyFile = "cert", "key"
+		}},
+		{"WebHTTPRedirectPort", func(wc *webConfig) {
+			wc.WebHTTPRedirectPort = 8081
+		}},
+		{"WebHTTPRedirectPort", func(wc *webConfig) {
+			wc.WebHTTPRedirectPort = wc.WebServerPort
+			wc.WebTLSCertFile, wc.WebTLSKeyFile = "cert", "key"
+		}},
+	}
+	for _, test := range tests {
+		wc := validWebConfig()
+		test.change(wc)
+		var want []string
+		if test.field != "" {
+			want = []string{test.field}
+		}
+		if got := invalidFields(wc.Validate()); !reflect.DeepEqual(got, want) {
+			t.Errorf("invalid fields = %v, want %v", got, want)
+		}
+	}
+}
+
+// Fields missing from a file get their defaults instead of failing
+// validation
+func TestMissingFieldsDefaulted(t *testing.T) {
+	wc := &webConfig{}
+	if err := json.Unmarshal([]byte(`{"Version": 1, "WebServerPort": 8080}`),
+		wc); err != nil {
+		t.Fatal(err)
+	}
+	wc.applyDefaults()
+	if err := wc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if wc.WebPongTimeout != defaultWebPongTimeout {
+		t.Errorf("WebPongTimeout = %d, want %d", wc.WebPongTimeout,
+			defaultWebPongTimeout)
+	}
+}
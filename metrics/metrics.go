@@ -0,0 +1,248 @@
+// metrics.go - Counters, gauges and histograms, written in the Prometheus
+// text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type kind string
+
+const (
+	counter   kind = "counter"
+	gauge     kind = "gauge"
+	histogram kind = "histogram"
+)
+
+// A value collected when the metrics are written, instead of being kept up
+// to date
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// histograms only: cumulative counts per bucket, and the sum
+	counts []uint64
+	sum    float64
+}
+
+// A metric with a fixed set of label names. Each distinct set of label
+// values is a separate series.
+type Family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+	collect func() []Sample
+	mutex   sync.Mutex
+	series  map[string]*series
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      []*Family
+)
+
+func register(f *Family) *Family {
+	f.series = make(map[string]*series)
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry = append(registry, f)
+	return f
+}
+
+func NewCounter(name, help string, labels ...string) *Family {
+	return register(&Family{name: name, help: help, kind: counter,
+		labels: labels})
+}
+
+func NewGauge(name, help string, labels ...string) *Family {
+	return register(&Family{name: name, help: help, kind: gauge,
+		labels: labels})
+}
+
+// buckets are the upper bounds, in increasing order
+func NewHistogram(name, help string, buckets []float64,
+	labels ...string) *Family {
+	return register(&Family{name: name, help: help, kind: histogram,
+		labels: labels, buckets: buckets})
+}
+
+func NewCounterFunc(name, help string, collect func() []Sample,
+	labels ...string) *Family {
+	return register(&Family{name: name, help: help, kind: counter,
+		labels: labels, collect: collect})
+}
+
+func NewGaugeFunc(name, help string, collect func() []Sample,
+	labels ...string) *Family {
+	return register(&Family{name: name, help: help, kind: gauge,
+		labels: labels, collect: collect})
+}
+
+// Must be called with the mutex held
+func (f *Family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, not %d", f.name,
+			len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\x00")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == histogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *Family) Add(v float64, labelValues ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.get(labelValues).value += v
+}
+
+func (f *Family) Inc(labelValues ...string) {
+	f.Add(1, labelValues...)
+}
+
+func (f *Family) Dec(labelValues ...string) {
+	f.Add(-1, labelValues...)
+}
+
+func (f *Family) Set(v float64, labelValues ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.get(labelValues).value = v
+}
+
+// Record a value in a histogram
+func (f *Family) Observe(v float64, labelValues ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s := f.get(labelValues)
+	for i, le := range f.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.value++
+	s.sum += v
+}
+
+// Forget every series whose label has this value, e.g. for a removed server
+func (f *Family) DeleteLabel(label, value string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for i, name := range f.labels {
+		if name != label {
+			continue
+		}
+		for key, s := range f.series {
+			if s.labelValues[i] == value {
+				delete(f.series, key)
+			}
+		}
+	}
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name,
+			labelEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], extra[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (f *Family) write(buf *bytes.Buffer) {
+	var all []*series
+	if f.collect != nil {
+		for _, s := range f.collect() {
+			all = append(all, &series{labelValues: s.LabelValues,
+				value: s.Value})
+		}
+	} else {
+		f.mutex.Lock()
+		for _, s := range f.series {
+			c := *s
+			c.counts = append([]uint64(nil), s.counts...)
+			all = append(all, &c)
+		}
+		f.mutex.Unlock()
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labelValues, "\x00") <
+			strings.Join(all[j].labelValues, "\x00")
+	})
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", f.name, helpEscaper.Replace(f.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.kind)
+	for _, s := range all {
+		if f.kind != histogram {
+			fmt.Fprintf(buf, "%s%s %s\n", f.name,
+				formatLabels(f.labels, s.labelValues), formatValue(s.value))
+			continue
+		}
+		for i, le := range f.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name,
+				formatLabels(f.labels, s.labelValues, "le", formatValue(le)),
+				s.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %s\n", f.name,
+			formatLabels(f.labels, s.labelValues, "le", "+Inf"),
+			formatValue(s.value))
+		fmt.Fprintf(buf, "%s_sum%s %s\n", f.name,
+			formatLabels(f.labels, s.labelValues), formatValue(s.sum))
+		fmt.Fprintf(buf, "%s_count%s %s\n", f.name,
+			formatLabels(f.labels, s.labelValues), formatValue(s.value))
+	}
+}
+
+// Write every registered metric
+func Write(w io.Writer) error {
+	registryMutex.Lock()
+	families := append([]*Family(nil), registry...)
+	registryMutex.Unlock()
+	var buf bytes.Buffer
+	for _, f := range families {
+		f.write(&buf)
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	Write(w)
+}
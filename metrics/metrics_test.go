@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func reset() {
+	registryMutex.Lock()
+	registry = nil
+	registryMutex.Unlock()
+}
+
+func output(t *testing.T) string {
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func check(t *testing.T, got, want string) {
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	reset()
+	c := NewCounter("test_requests_total", "Requests, by method and code.",
+		"method", "code")
+	c.Inc("GET", "200")
+	c.Inc("GET", "200")
+	c.Add(0.5, "POST", "500")
+	c.Inc("GET", "404")
+	check(t, output(t), `# HELP test_requests_total Requests, by method and code.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",code="200"} 2
+test_requests_total{method="GET",code="404"} 1
+test_requests_total{method="POST",code="500"} 0.5
+`)
+}
+
+func TestGauge(t *testing.T) {
+	reset()
+	g := NewGauge("test_open", "Open things.")
+	g.Set(3)
+	g.Dec()
+	NewGaugeFunc("test_collected", "Collected when written.",
+		func() []Sample {
+			return []Sample{
+				{LabelValues: []string{"b"}, Value: math.Inf(1)},
+				{LabelValues: []string{"a"}, Value: -2},
+			}
+		}, "name")
+	check(t, output(t), `# HELP test_open Open things.
+# TYPE test_open gauge
+test_open 2
+# HELP test_collected Collected when written.
+# TYPE test_collected gauge
+test_collected{name="a"} -2
+test_collected{name="b"} +Inf
+`)
+}
+
+func TestHistogram(t *testing.T) {
+	reset()
+	h := NewHistogram("test_seconds", "Time taken.", []float64{0.1, 1, 10},
+		"server")
+	for _, v := range []float64{0.05, 0.1, 0.5, 5, 50} {
+		h.Observe(v, "one")
+	}
+	check(t, output(t), `# HELP test_seconds Time taken.
+# TYPE test_seconds histogram
+test_seconds_bucket{server="one",le="0.1"} 2
+test_seconds_bucket{server="one",le="1"} 3
+test_seconds_bucket{server="one",le="10"} 4
+test_seconds_bucket{server="one",le="+Inf"} 5
+test_seconds_sum{server="one"} 55.65
+test_seconds_count{server="one"} 5
+`)
+}
+
+func TestHistogramWithoutLabels(t *testing.T) {
+	reset()
+	h := NewHistogram("test_bytes", "Sizes.", []float64{100})
+	h.Observe(10)
+	check(t, output(t), `# HELP test_bytes Sizes.
+# TYPE test_bytes histogram
+test_bytes_bucket{le="100"} 1
+test_bytes_bucket{le="+Inf"} 1
+test_bytes_sum 10
+test_bytes_count 1
+`)
+}
+
+func TestEscaping(t *testing.T) {
+	reset()
+	c := NewCounter("test_escaped_total", "Back\\slash and\nnewline \"quoted\".",
+		"user")
+	c.Inc("a\"b\\c\nd")
+	check(t, output(t), `# HELP test_escaped_total Back\\slash and\nnewline "quoted".
+# TYPE test_escaped_total counter
+test_escaped_total{user="a\"b\\c\nd"} 1
+`)
+}
+
+func TestDeleteLabel(t *testing.T) {
+	reset()
+	c := NewCounter("test_commands_total", "Commands.", "user", "server")
+	c.Inc("alice", "one")
+	c.Inc("alice", "two")
+	c.Inc("bob", "two")
+	c.DeleteLabel("server", "two")
+	check(t, output(t), `# HELP test_commands_total Commands.
+# TYPE test_commands_total counter
+test_commands_total{user="alice",server="one"} 1
+`)
+}
+
+func TestHandler(t *testing.T) {
+	reset()
+	NewCounter("test_total", "Things.").Inc()
+	w := httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("Content-Type = %q, want %q", ct, ContentType)
+	}
+	check(t, w.Body.String(), "# HELP test_total Things.\n"+
+		"# TYPE test_total counter\ntest_total 1\n")
+}
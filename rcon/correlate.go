@@ -0,0 +1,114 @@
+// correlate.go - Matching rcon output to the command that caused it.
+//
+// QL has no request ids, so commands for a server are sent one at a time and
+// all output received until the server goes quiet is taken to be the
+// response to the command in flight.
+package rcon
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"webqlrc/bridge"
+)
+
+const commandQueueSize = 64
+
+type pendingCommand struct {
+	request    *bridge.Message
+	sentAt     time.Time
+	lastOutput time.Time
+	output     []string
+}
+
+// Queue a command from the web UI; it is sent once the commands queued before
+// it have been answered.
+func (srv *qlServer) queueCommand(m *bridge.Message) error {
+	// Held until queued so a server being removed can't miss the command
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.removed {
+		return fmt.Errorf("Unknown server '%s'", srv.id)
+	}
+	if m.CorrelationId == "" {
+		srv.commandSeq++
+		m.CorrelationId = fmt.Sprintf("%s-%d", srv.id, srv.commandSeq)
+	}
+	select {
+	case srv.commands <- m:
+		return nil
+	default:
+		return fmt.Errorf("Too many commands queued for server '%s'", srv.id)
+	}
+}
+
+// Send the next queued command if none is in flight. Only called from the
+// server's poll loop.
+func (srv *qlServer) sendNextCommand() {
+	if srv.inFlight != nil {
+		return
+	}
+	for {
+		var m *bridge.Message
+		select {
+		case m = <-srv.commands:
+		default:
+			return
+		}
+		// The API gives up on commands that wait too long in the queue
+		if m.Client != nil && m.Client.Abandoned() {
+			fmt.Printf("Dropping command for %s, its client has gone: %s\n",
+				srv.id, m.Data)
+			continue
+		}
+		if err := srv.send(string(m.Data)); err != nil {
+			replyToWeb(m, bridge.MsgError, []byte(err.Error()))
+			return
+		}
+		srv.inFlight = &pendingCommand{request: m, sentAt: time.Now()}
+		return
+	}
+}
+
+// Returns true if the output belongs to the command in flight
+func (srv *qlServer) collectOutput(output string) bool {
+	if srv.inFlight == nil {
+		return false
+	}
+	srv.inFlight.output = append(srv.inFlight.output, output)
+	srv.inFlight.lastOutput = time.Now()
+	return true
+}
+
+// Finish the command in flight once the server has been quiet long enough
+// after answering, or hasn't answered at all before the timeout.
+func (srv *qlServer) checkCommandDone(now time.Time) {
+	p := srv.inFlight
+	if p == nil {
+		return
+	}
+	rconcfg := currentCfg().Rcon
+	quiet := rconcfg.QlZmqResponseQuietPeriod * time.Millisecond
+	timeout := rconcfg.QlZmqResponseTimeout * time.Millisecond
+	answered := len(p.output) > 0 && now.Sub(p.lastOutput) >= quiet
+	timedOut := len(p.output) == 0 && now.Sub(p.sentAt) >= timeout
+	if !answered && !timedOut {
+		return
+	}
+	srv.inFlight = nil
+	result := &bridge.CommandResult{
+		Command:  string(p.request.Data),
+		Output:   strings.Join(p.output, ""),
+		TimedOut: timedOut,
+	}
+	if rconcfg.QlZmqShowOnConsole {
+		fmt.Printf("[%s %s] %s\n", bridge.MsgResult, srv.id, result.Output)
+	}
+	reply := bridge.NewMessage(bridge.MsgResult, srv.id, nil)
+	reply.Payload = result
+	reply.CorrelationId = p.request.CorrelationId
+	reply.Client = p.request.Client
+	go func() {
+		bridge.MessageBridge.RconToWeb <- reply
+	}()
+}
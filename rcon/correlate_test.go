@@ -0,0 +1,256 @@
+package rcon
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+	"webqlrc/bridge"
+	"webqlrc/config"
+)
+
+const (
+	testQuiet   = 100 * time.Millisecond
+	testTimeout = time.Second
+)
+
+func TestMain(m *testing.M) {
+	go bridge.MessageBridge.PassMessages()
+	os.Exit(m.Run())
+}
+
+type sentActions struct {
+	mutex   sync.Mutex
+	actions []string
+}
+
+func (s *sentActions) get() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.actions...)
+}
+
+// A server whose commands are recorded instead of sent to QL
+func testServer(t *testing.T) (*qlServer, *sentActions) {
+	var c config.Config
+	err := json.Unmarshal([]byte(`{"Rcon": {
+		"QlZmqResponseQuietPeriod": 100,
+		"QlZmqResponseTimeout": 1000
+	}}`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgMutex.Lock()
+	cfg = &c
+	cfgMutex.Unlock()
+
+	sent := &sentActions{}
+	sendRconAction = func(_ *qlZmqSocket, action string) {
+		sent.mutex.Lock()
+		defer sent.mutex.Unlock()
+		sent.actions = append(sent.actions, action)
+	}
+	srv := newQlServer(&config.RconServerConfig{Id: "one", QlZmqHost: "h",
+		QlZmqRconPort: 27960})
+	srv.rcon = &qlZmqSocket{}
+	return srv, sent
+}
+
+func register(clients ...*bridge.WebClient) {
+	for _, c := range clients {
+		bridge.MessageBridge.Register <- c
+	}
+}
+
+// Returns once the bridge has removed the clients
+func unregister(clients ...*bridge.WebClient) {
+	for _, c := range clients {
+		bridge.MessageBridge.Unregister <- c
+	}
+	// The bridge handles one request at a time, so this isn't received
+	// until the ones before it are done
+	barrier := bridge.NewWebClient()
+	bridge.MessageBridge.Register <- barrier
+	bridge.MessageBridge.Unregister <- barrier
+}
+
+func command(t *testing.T, srv *qlServer, c *bridge.WebClient,
+	cmd string) *bridge.Message {
+	m := bridge.NewMessage(bridge.MsgRcon, srv.id, []byte(cmd))
+	m.Client = c
+	if err := srv.queueCommand(m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func receive(t *testing.T, c *bridge.WebClient) *bridge.Message {
+	select {
+	case m, ok := <-c.Send:
+		if !ok {
+			t.Fatal("client was removed")
+		}
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("no message for client")
+	}
+	return nil
+}
+
+func receiveNothing(t *testing.T, c *bridge.WebClient) {
+	select {
+	case m, ok := <-c.Send:
+		if ok {
+			t.Errorf("unexpected message %+v", m)
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func checkResult(t *testing.T, m *bridge.Message, id string,
+	want *bridge.CommandResult) {
+	if m.Type != bridge.MsgResult || m.CorrelationId != id {
+		t.Errorf("got %s message for %q, want result for %q", m.Type,
+			m.CorrelationId, id)
+	}
+	if got, ok := m.Payload.(*bridge.CommandResult); !ok ||
+		!reflect.DeepEqual(got, want) {
+		t.Errorf("result = %+v, want %+v", m.Payload, want)
+	}
+}
+
+func TestCorrelationIds(t *testing.T) {
+	srv, _ := testServer(t)
+	a := command(t, srv, nil, "status")
+	b := bridge.NewMessage(bridge.MsgRcon, srv.id, []byte("players"))
+	b.CorrelationId = "mine"
+	if err := srv.queueCommand(b); err != nil {
+		t.Fatal(err)
+	}
+	c := command(t, srv, nil, "serverinfo")
+	got := []string{a.CorrelationId, b.CorrelationId, c.CorrelationId}
+	if want := []string{"one-1", "mine", "one-2"}; !reflect.DeepEqual(got,
+		want) {
+		t.Errorf("correlation ids = %v, want %v", got, want)
+	}
+}
+
+// Commands are sent one at a time; the result goes only to the client that
+// sent the command
+func TestOneCommandInFlight(t *testing.T) {
+	srv, sent := testServer(t)
+	alice, bob := bridge.NewWebClient(), bridge.NewWebClient()
+	register(alice, bob)
+	defer unregister(alice, bob)
+
+	status := command(t, srv, alice, "status")
+	command(t, srv, bob, "serverinfo")
+	srv.sendNextCommand()
+	srv.sendNextCommand()
+	if got, want := sent.get(), []string{"status"}; !reflect.DeepEqual(got,
+		want) {
+		t.Fatalf("sent %v, want %v", got, want)
+	}
+
+	if !srv.collectOutput("map: campgrounds\n") ||
+		!srv.collectOutput("num score ping name\n") {
+		t.Fatal("output not taken as the response")
+	}
+	lastOutput := srv.inFlight.lastOutput
+	srv.checkCommandDone(lastOutput.Add(testQuiet - time.Millisecond))
+	if srv.inFlight == nil {
+		t.Fatal("command finished before the quiet period")
+	}
+	srv.sendNextCommand()
+	if len(sent.get()) != 1 {
+		t.Fatalf("second command sent while the first was in flight")
+	}
+
+	srv.checkCommandDone(lastOutput.Add(testQuiet))
+	checkResult(t, receive(t, alice), status.CorrelationId,
+		&bridge.CommandResult{
+			Command: "status",
+			Output:  "map: campgrounds\nnum score ping name\n",
+		})
+	receiveNothing(t, bob)
+
+	srv.sendNextCommand()
+	if got, want := sent.get(), []string{"status", "serverinfo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	srv, _ := testServer(t)
+	alice := bridge.NewWebClient()
+	register(alice)
+	defer unregister(alice)
+
+	m := command(t, srv, alice, "quiet")
+	srv.sendNextCommand()
+	sentAt := srv.inFlight.sentAt
+	srv.checkCommandDone(sentAt.Add(testTimeout - time.Millisecond))
+	if srv.inFlight == nil {
+		t.Fatal("command timed out early")
+	}
+	srv.checkCommandDone(sentAt.Add(testTimeout))
+	checkResult(t, receive(t, alice), m.CorrelationId,
+		&bridge.CommandResult{Command: "quiet", TimedOut: true})
+}
+
+// Output with no command in flight is left to be broadcast
+func TestUnsolicitedOutput(t *testing.T) {
+	srv, _ := testServer(t)
+	if srv.collectOutput("broadcast: print \"hi\"\n") {
+		t.Error("output taken as a response with no command in flight")
+	}
+}
+
+// A client that goes away while its command is in flight doesn't get the
+// result or hold up the next command
+func TestClientGoneWhileInFlight(t *testing.T) {
+	srv, sent := testServer(t)
+	alice, bob := bridge.NewWebClient(), bridge.NewWebClient()
+	register(alice, bob)
+	defer unregister(bob)
+
+	command(t, srv, alice, "status")
+	next := command(t, srv, bob, "serverinfo")
+	srv.sendNextCommand()
+	unregister(alice)
+	srv.collectOutput("map: campgrounds\n")
+	srv.checkCommandDone(srv.inFlight.lastOutput.Add(testQuiet))
+	if _, ok := <-alice.Send; ok {
+		t.Error("removed client got the result")
+	}
+	receiveNothing(t, bob)
+
+	srv.sendNextCommand()
+	srv.collectOutput("hostname: test\n")
+	srv.checkCommandDone(srv.inFlight.lastOutput.Add(testQuiet))
+	checkResult(t, receive(t, bob), next.CorrelationId,
+		&bridge.CommandResult{Command: "serverinfo",
+			Output: "hostname: test\n"})
+	if got, want := sent.get(), []string{"status", "serverinfo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
+
+// Queued commands from an API request that has given up aren't sent
+func TestAbandonedCommandDropped(t *testing.T) {
+	srv, sent := testServer(t)
+	api, bob := bridge.NewDirectClient(), bridge.NewWebClient()
+	register(api, bob)
+	defer unregister(bob)
+
+	command(t, srv, api, "kick 3")
+	command(t, srv, bob, "status")
+	unregister(api)
+	srv.sendNextCommand()
+	if got, want := sent.get(), []string{"status"}; !reflect.DeepEqual(got,
+		want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
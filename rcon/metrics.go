@@ -0,0 +1,70 @@
+// metrics.go - RCON connection metrics.
+package rcon
+
+import "webqlrc/metrics"
+
+var (
+	monitorEvents = metrics.NewCounter("webqlrc_zmq_monitor_events_total",
+		"ZMQ monitor events, by server and event.", "server", "event")
+	pollDuration = metrics.NewHistogram("webqlrc_rcon_poll_loop_seconds",
+		"Time taken by each iteration of a server's poll loop, including waiting up to QlZmqRconPollTimeout for messages.",
+		[]float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "server")
+	commandsSent = metrics.NewCounter("webqlrc_rcon_commands_total",
+		"RCON commands sent from the web UI and API, by user and server.",
+		"user", "server")
+)
+
+func init() {
+	metrics.NewGaugeFunc("webqlrc_rcon_connection_state",
+		"1 for the current RCON connection state of each server, 0 for the others.",
+		connectionStates, "server", "state")
+	metrics.NewCounterFunc("webqlrc_rcon_reconnects_total",
+		"Times each server's RCON connection was re-established.",
+		reconnectCounts, "server")
+}
+
+func connectionStates() []metrics.Sample {
+	states := []connState{stateConnecting, stateConnected, stateDisconnected,
+		stateAuthFailed}
+	var samples []metrics.Sample
+	for _, s := range Servers() {
+		for _, state := range states {
+			value := 0.0
+			if s.State == state.String() {
+				value = 1
+			}
+			samples = append(samples, metrics.Sample{
+				LabelValues: []string{s.Id, state.String()},
+				Value:       value,
+			})
+		}
+	}
+	return samples
+}
+
+func reconnectCounts() []metrics.Sample {
+	var samples []metrics.Sample
+	for _, s := range Servers() {
+		samples = append(samples, metrics.Sample{
+			LabelValues: []string{s.Id},
+			Value:       float64(s.Reconnects),
+		})
+	}
+	return samples
+}
+
+// Count a command sent from the web UI or API. Commands for servers that
+// don't exist aren't counted, so clients can't add series at will.
+func CountCommand(user, id string) {
+	serversMutex.RLock()
+	defer serversMutex.RUnlock()
+	if _, ok := servers[id]; ok {
+		commandsSent.Inc(user, id)
+	}
+}
+
+func forgetServerMetrics(id string) {
+	monitorEvents.DeleteLabel("server", id)
+	pollDuration.DeleteLabel("server", id)
+	commandsSent.DeleteLabel("server", id)
+}
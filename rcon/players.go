@@ -0,0 +1,227 @@
+// players.go - Player table built from the output of QL's status and players
+// commands.
+package rcon
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Player struct {
+	Slot      int    `json:"slot"`
+	Name      string `json:"name"`
+	CleanName string `json:"clean_name"`
+	SteamId   string `json:"steam_id,omitempty"`
+	Score     int    `json:"score"`
+	Ping      int    `json:"ping"`
+	Address   string `json:"address,omitempty"`
+	Team      string `json:"team,omitempty"`
+}
+
+type playerBlock int
+
+const (
+	blockNone    playerBlock = 0
+	blockStatus  playerBlock = 1
+	blockPlayers playerBlock = 2
+)
+
+type playerTable struct {
+	mutex   sync.Mutex
+	players map[int]*Player
+	// partial line left over from the last frame
+	partial string
+	block   playerBlock
+	seen    map[int]bool
+	// the status listing has Q3's lastmsg and qport columns
+	q3Status bool
+	// a row in the listing couldn't be parsed
+	ragged  bool
+	changed bool
+}
+
+var (
+	colorCodes = regexp.MustCompile(`\^[0-9]`)
+	// num score ping name            address               rate
+	statusHeader = regexp.MustCompile(`^\s*num\s+score\s+ping\s+name`)
+	statusDashes = regexp.MustCompile(`^[\s-]+$`)
+	//   3    12   45 ^1Player^7       10.0.0.10:27960       25000
+	statusRow = regexp.MustCompile(
+		`^\s*(\d+)\s+(-?\d+)\s+(\d+|CNCT|ZMBI)\s+(.*?)\s+(\S+)\s+(\d+)\s*$`)
+	// Q3's layout, with lastmsg before the address and qport after it
+	//   3    12   45 ^1Player^7          50 10.0.0.10:27960         1234 25000
+	q3StatusRow = regexp.MustCompile(
+		`^\s*(\d+)\s+(-?\d+)\s+(\d+|CNCT|ZMBI)\s+(.*?)\s+\d+\s+(\S+)\s+\d+\s+(\d+)\s*$`)
+	//  3 [R] ^1Player^7 76561198000000000
+	// Bots have a SteamID of 0.
+	playersRow = regexp.MustCompile(
+		`^\s*(\d+)\s+(?:\[([A-Za-z])\]\s+)?(.*?)\s+\(?(\d{17}|0)\)?\s*$`)
+	// Anything starting with a slot number is taken to be meant as a row
+	rowStart  = regexp.MustCompile(`^\s*\d+\s`)
+	teamNames = map[string]string{
+		"R": "red",
+		"B": "blue",
+		"S": "spectator",
+		"F": "free",
+	}
+)
+
+func newPlayerTable() *playerTable {
+	return &playerTable{players: make(map[int]*Player)}
+}
+
+func stripColors(name string) string {
+	return colorCodes.ReplaceAllString(name, "")
+}
+
+func (pt *playerTable) player(slot int, name string) *Player {
+	p, ok := pt.players[slot]
+	// a different player has taken over the slot
+	if ok && stripColors(name) != p.CleanName {
+		ok = false
+	}
+	if !ok {
+		p = &Player{Slot: slot}
+		pt.players[slot] = p
+	}
+	p.Name = name
+	p.CleanName = stripColors(name)
+	return p
+}
+
+// End of a status/players listing: drop anyone who wasn't listed, unless
+// part of the listing couldn't be parsed
+func (pt *playerTable) endBlock() {
+	if pt.block == blockNone {
+		return
+	}
+	if !pt.ragged {
+		for slot := range pt.players {
+			if !pt.seen[slot] {
+				delete(pt.players, slot)
+			}
+		}
+	}
+	pt.block = blockNone
+	pt.seen = nil
+	pt.ragged = false
+	pt.changed = true
+}
+
+func (pt *playerTable) startBlock(block playerBlock) {
+	pt.endBlock()
+	pt.block = block
+	pt.seen = make(map[int]bool)
+}
+
+func (pt *playerTable) parseStatusRow(line string) bool {
+	row := statusRow
+	if pt.q3Status {
+		row = q3StatusRow
+	}
+	m := row.FindStringSubmatch(line)
+	if m == nil {
+		return false
+	}
+	slot, _ := strconv.Atoi(m[1])
+	p := pt.player(slot, m[4])
+	p.Score, _ = strconv.Atoi(m[2])
+	p.Ping, _ = strconv.Atoi(m[3])
+	p.Address = m[5]
+	pt.seen[slot] = true
+	return true
+}
+
+func (pt *playerTable) parsePlayersRow(line string) bool {
+	m := playersRow.FindStringSubmatch(line)
+	if m == nil {
+		return false
+	}
+	if pt.block != blockPlayers {
+		pt.startBlock(blockPlayers)
+	}
+	slot, _ := strconv.Atoi(m[1])
+	p := pt.player(slot, m[3])
+	if m[4] != "0" {
+		p.SteamId = m[4]
+	}
+	if team, ok := teamNames[strings.ToUpper(m[2])]; ok {
+		p.Team = team
+	}
+	pt.seen[slot] = true
+	return true
+}
+
+// A listing ends with a blank line, the start of another listing, or the
+// server going quiet. Other console output may be interleaved with it.
+func (pt *playerTable) parseLine(line string) {
+	if statusHeader.MatchString(line) {
+		pt.startBlock(blockStatus)
+		pt.q3Status = strings.Contains(line, "lastmsg")
+		return
+	}
+	if strings.TrimSpace(line) == "" {
+		pt.endBlock()
+		return
+	}
+	if pt.block == blockStatus &&
+		(statusDashes.MatchString(line) || pt.parseStatusRow(line)) {
+		return
+	}
+	if pt.parsePlayersRow(line) {
+		return
+	}
+	if pt.block != blockNone && rowStart.MatchString(line) {
+		pt.ragged = true
+	}
+}
+
+// Feed a frame of rcon output into the table. Returns true when the player
+// table has changed and should be pushed out.
+func (pt *playerTable) feed(output string) bool {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	lines := strings.Split(pt.partial+output, "\n")
+	pt.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		pt.parseLine(strings.TrimRight(line, "\r"))
+	}
+	return pt.takeChanged()
+}
+
+// Called when the server has gone quiet; a listing without a trailing blank
+// line is complete by now.
+func (pt *playerTable) flush() bool {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	if pt.partial != "" {
+		pt.parseLine(pt.partial)
+		pt.partial = ""
+	}
+	pt.endBlock()
+	return pt.takeChanged()
+}
+
+func (pt *playerTable) takeChanged() bool {
+	changed := pt.changed
+	pt.changed = false
+	return changed
+}
+
+// Current players ordered by slot
+func (pt *playerTable) list() []*Player {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	players := make([]*Player, 0, len(pt.players))
+	for _, p := range pt.players {
+		cp := *p
+		players = append(players, &cp)
+	}
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].Slot < players[j].Slot
+	})
+	return players
+}
@@ -0,0 +1,163 @@
+package rcon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	qlStatus = "map: campgrounds\n" +
+		"num score ping name            address               rate\n" +
+		"--- ----- ---- --------------- --------------------- -----\n" +
+		"  0    15    0 ^1Anarki^7      bot                   16384\n" +
+		"  1    22   48 ^4Mr ^1Big^7    203.0.113.7:27960     25000\n" +
+		"  2     0  999 Spec Tator      198.51.100.2:27960    25000\n" +
+		"  3     0 CNCT newbie 2        192.0.2.9:27960       25000\n" +
+		"\n"
+	q3Status = "map: q3dm17\n" +
+		"num score ping name            lastmsg address               qport rate\n" +
+		"--- ----- ---- --------------- ------- --------------------- ----- -----\n" +
+		"  1    22   48 ^4Mr ^1Big^7          50 203.0.113.7:27960     1234 25000\n" +
+		"  2    -1   60 Spec Tator            0 198.51.100.2:27960    4321 25000\n" +
+		"\n"
+	qlPlayers = " 0 [R] ^1Anarki^7 0\n" +
+		" 1 [B] ^4Mr ^1Big^7 76561198000000001\n" +
+		" 2 [S] Spec Tator 76561198000000002\n" +
+		"\n"
+)
+
+type playerRow struct {
+	slot             int
+	name, clean      string
+	steamId, address string
+	score, ping      int
+	team             string
+}
+
+func rows(pt *playerTable) []playerRow {
+	var out []playerRow
+	for _, p := range pt.list() {
+		out = append(out, playerRow{p.Slot, p.Name, p.CleanName, p.SteamId,
+			p.Address, p.Score, p.Ping, p.Team})
+	}
+	return out
+}
+
+var (
+	anarki = playerRow{0, "^1Anarki^7", "Anarki", "", "bot", 15, 0, ""}
+	mrBig  = playerRow{1, "^4Mr ^1Big^7", "Mr Big", "",
+		"203.0.113.7:27960", 22, 48, ""}
+	spec = playerRow{2, "Spec Tator", "Spec Tator", "",
+		"198.51.100.2:27960", 0, 999, ""}
+	newbie = playerRow{3, "newbie 2", "newbie 2", "", "192.0.2.9:27960", 0,
+		0, ""}
+)
+
+func TestPlayerTable(t *testing.T) {
+	withTeams := func(r playerRow, steamId, team string) playerRow {
+		r.steamId = steamId
+		r.team = team
+		return r
+	}
+	tests := []struct {
+		name   string
+		frames []string
+		want   []playerRow
+	}{
+		{
+			name:   "QL status",
+			frames: []string{qlStatus},
+			want:   []playerRow{anarki, mrBig, spec, newbie},
+		},
+		{
+			name:   "Q3 status",
+			frames: []string{q3Status},
+			want: []playerRow{mrBig, {2, "Spec Tator", "Spec Tator", "",
+				"198.51.100.2:27960", -1, 60, ""}},
+		},
+		{
+			name:   "status then players",
+			frames: []string{qlStatus, qlPlayers},
+			want: []playerRow{
+				withTeams(anarki, "", "red"),
+				withTeams(mrBig, "76561198000000001", "blue"),
+				withTeams(spec, "76561198000000002", "spectator"),
+			},
+		},
+		{
+			name:   "player left",
+			frames: []string{qlStatus, strings.Replace(qlStatus, "  3     0 CNCT newbie 2        192.0.2.9:27960       25000\n", "", 1)},
+			want:   []playerRow{anarki, mrBig, spec},
+		},
+		{
+			name: "slot taken by someone else",
+			frames: []string{qlStatus, qlPlayers,
+				" 0 [F] Sarge 76561198000000009\n\n"},
+			want: []playerRow{{0, "Sarge", "Sarge", "76561198000000009", "",
+				0, 0, "free"}},
+		},
+		{
+			name: "chat interleaved with the listing",
+			frames: []string{strings.Replace(qlStatus, "  2 ",
+				"broadcast: print \"Anarki: hi\"\n  2 ", 1)},
+			want: []playerRow{anarki, mrBig, spec, newbie},
+		},
+		{
+			name: "unparseable row keeps everyone",
+			frames: []string{qlStatus, "num score ping name address rate\n" +
+				"  0    16    0 ^1Anarki^7      bot                   16384\n" +
+				"  1 garbled\n\n"},
+			want: []playerRow{{0, "^1Anarki^7", "Anarki", "", "bot", 16, 0,
+				""}, mrBig, spec, newbie},
+		},
+		{
+			name: "listing cut short by the next one",
+			frames: []string{qlStatus, "num score ping name address rate\n" +
+				"  0    16    0 ^1Anarki^7      bot                   16384\n",
+				qlStatus},
+			want: []playerRow{anarki, mrBig, spec, newbie},
+		},
+	}
+	for _, test := range tests {
+		pt := newPlayerTable()
+		for _, f := range test.frames {
+			pt.feed(f)
+		}
+		pt.flush()
+		if got := rows(pt); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", test.name, got, test.want)
+		}
+	}
+}
+
+// However the output is split into frames, the result is the same
+func TestPlayerTableFrames(t *testing.T) {
+	output := qlStatus + qlPlayers
+	whole := newPlayerTable()
+	whole.feed(output)
+	whole.flush()
+	want := rows(whole)
+	for i := 1; i < len(output); i++ {
+		pt := newPlayerTable()
+		pt.feed(output[:i])
+		pt.feed(output[i:])
+		pt.flush()
+		if got := rows(pt); !reflect.DeepEqual(got, want) {
+			t.Fatalf("split at %d:\ngot  %+v\nwant %+v", i, got, want)
+		}
+	}
+}
+
+// A listing that hasn't ended yet doesn't remove anyone
+func TestPlayerTablePartialListing(t *testing.T) {
+	pt := newPlayerTable()
+	pt.feed(qlStatus)
+	pt.flush()
+	if pt.feed("num score ping name address rate\n  0    15    0 ^1Anar") {
+		t.Error("feed reported a change for an unfinished listing")
+	}
+	if got, want := rows(pt), []playerRow{anarki, mrBig, spec, newbie}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+}
@@ -15,39 +15,96 @@ import (
 type qlSocketOrMsgType int
 
 type message struct {
-	incoming     chan string
+	contents     string
+	payload      interface{}
 	msgType      qlSocketOrMsgType
+	serverId     string
 	timeReceived time.Time
 }
 
 type qlZmqSocket struct {
 	address      string
 	context      *zmq.Context
+	mutex        sync.Mutex
 	socket       *zmq.Socket
 	typeQlSocket qlSocketOrMsgType
 }
 
+type qlServer struct {
+	id            string
+	address       string
+	password      string
+	statsAddress  string
+	statsPassword string
+	mutex         sync.Mutex
+	rcon          *qlZmqSocket
+	status        *connStatus
+	players       *playerTable
+	commands      chan *bridge.Message
+	commandSeq    int
+	removed       bool
+	// Bumped each time the sockets are recreated so the monitor address is
+	// never reused
+	generation int
+	stop       chan struct{}
+	stopped    chan struct{}
+	// only touched by the poll loop
+	inFlight *pendingCommand
+}
+
 const (
-	smtRcon        qlSocketOrMsgType = 0
-	smtMonitor     qlSocketOrMsgType = 1
-	monitorAddress                   = "inproc://monitor-sock"
+	smtRcon              qlSocketOrMsgType = 0
+	smtMonitor           qlSocketOrMsgType = 1
+	smtStatus            qlSocketOrMsgType = 2
+	smtPlayers           qlSocketOrMsgType = 3
+	smtStats             qlSocketOrMsgType = 4
+	monitorAddressFormat                   = "inproc://monitor-sock-%s-%d"
 )
 
 var cfg *config.Config
-var socketMutex = &sync.Mutex{}
+var cfgMutex sync.RWMutex
+var zmqContext *zmq.Context
+var servers = make(map[string]*qlServer)
+var serverOrder []string
+var serversMutex sync.RWMutex
 
-func createSockets() ([]*qlZmqSocket, error) {
-	ctx, err := zmq.NewContext()
-	if err != nil {
-		return nil, fmt.Errorf("Context error: %s", err)
+func currentCfg() *config.Config {
+	cfgMutex.RLock()
+	defer cfgMutex.RUnlock()
+	return cfg
+}
+
+func newQlServer(s *config.RconServerConfig) *qlServer {
+	srv := &qlServer{
+		id:       s.Id,
+		status:   newConnStatus(),
+		players:  newPlayerTable(),
+		commands: make(chan *bridge.Message, commandQueueSize),
+	}
+	srv.configure(s)
+	return srv
+}
+
+// Set the connection settings; the sockets must not be open.
+func (srv *qlServer) configure(s *config.RconServerConfig) {
+	srv.address = fmt.Sprintf("tcp://%s:%d", s.QlZmqHost, s.QlZmqRconPort)
+	srv.password = s.QlZmqRconPassword
+	srv.statsAddress = ""
+	srv.statsPassword = ""
+	if s.StatsEnabled() {
+		srv.statsAddress = s.StatsAddress()
+		srv.statsPassword = s.QlZmqStatsPassword
 	}
-	rconsocket, err := newQlZmqSocket(fmt.Sprintf("tcp://%s:%d", cfg.Rcon.QlZmqHost,
-		cfg.Rcon.QlZmqRconPort), ctx, zmq.DEALER)
+}
 
+func createSockets(srv *qlServer) ([]*qlZmqSocket, error) {
+	rconsocket, err := newQlZmqSocket(srv.address, zmqContext, zmq.DEALER)
 	if err != nil {
 		return nil, err
 	}
-	monitorsocket, err := newQlZmqSocket(monitorAddress, ctx, zmq.PAIR)
+	monitorAddress := fmt.Sprintf(monitorAddressFormat, srv.id,
+		srv.generation)
+	monitorsocket, err := newQlZmqSocket(monitorAddress, zmqContext, zmq.PAIR)
 	if err != nil {
 		return nil, err
 	}
@@ -60,23 +117,37 @@ func createSockets() ([]*qlZmqSocket, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Unable to connect to monitor socket: %s", err)
 	}
-	err = rconsocket.openQlConnection(cfg.Rcon.QlZmqRconPassword)
+	err = rconsocket.openQlConnection(srv.password)
 	if err != nil {
 		return nil, fmt.Errorf("Connection error: %s", err)
 	}
+	if srv.statsAddress != "" {
+		statssocket, err := newQlZmqSocket(srv.statsAddress, zmqContext,
+			zmq.SUB)
+		if err != nil {
+			return nil, err
+		}
+		err = statssocket.openStatsConnection(srv.statsPassword)
+		if err != nil {
+			return nil, fmt.Errorf("Stats connection error: %s", err)
+		}
+		socks = append(socks, statssocket)
+	}
 	return socks, nil
 }
 
 func newQlZmqSocket(address string, context *zmq.Context,
 	zmqSockType zmq.Type) (*qlZmqSocket, error) {
 
-	s, err := zmq.NewSocket(zmqSockType)
+	s, err := context.NewSocket(zmqSockType)
 	var qlstype qlSocketOrMsgType
 
 	if zmqSockType == zmq.DEALER {
 		qlstype = smtRcon
 	} else if zmqSockType == zmq.PAIR {
 		qlstype = smtMonitor
+	} else if zmqSockType == zmq.SUB {
+		qlstype = smtStats
 	}
 
 	if err != nil {
@@ -98,104 +169,278 @@ func (rconsock *qlZmqSocket) openQlConnection(password string) error {
 	rconsock.socket.SetZapDomain("rcon")
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	rconsock.socket.SetIdentity(fmt.Sprintf("i-%d", r.Int31n(2147483647)))
+	// ZMQ reconnects on its own; the interval doubles on each failed attempt
+	// until it reaches the maximum
+	rconsock.socket.SetReconnectIvl(currentCfg().Rcon.QlZmqReconnectInterval *
+		time.Millisecond)
+	rconsock.socket.SetReconnectIvlMax(currentCfg().Rcon.QlZmqReconnectMaxInterval *
+		time.Millisecond)
 	fmt.Printf("Attempting to establish RCON connection to: %s\n", rconsock.address)
 	err := rconsock.socket.Connect(rconsock.address)
 	if err != nil {
 		return fmt.Errorf("Unable to establish RCON connection: %s", err)
 	}
-	fmt.Printf("Registering connection to %s\n", rconsock.address)
-	rconsock.socket.Send("register", 0)
+	// "register" is sent once the monitor reports that we're connected
+	return nil
+}
+
+func (statssock *qlZmqSocket) openStatsConnection(password string) error {
+	statssock.socket.SetPlainUsername("stats")
+	statssock.socket.SetPlainPassword(password)
+	statssock.socket.SetZapDomain("stats")
+	statssock.socket.SetReconnectIvl(currentCfg().Rcon.QlZmqReconnectInterval *
+		time.Millisecond)
+	statssock.socket.SetReconnectIvlMax(currentCfg().Rcon.QlZmqReconnectMaxInterval *
+		time.Millisecond)
+	err := statssock.socket.SetSubscribe("")
+	if err != nil {
+		return fmt.Errorf("Unable to subscribe to stats: %s", err)
+	}
+	fmt.Printf("Attempting to establish stats connection to: %s\n",
+		statssock.address)
+	err = statssock.socket.Connect(statssock.address)
+	if err != nil {
+		return fmt.Errorf("Unable to establish stats connection: %s", err)
+	}
 	return nil
 }
 
 func (rconsock *qlZmqSocket) doRconAction(action string) {
 	// ZMQ sockets are not thread-safe
-	socketMutex.Lock()
-	defer socketMutex.Unlock()
+	rconsock.mutex.Lock()
+	defer rconsock.mutex.Unlock()
 	rconsock.socket.Send(action, 0)
 }
 
-func readZmqSocketMsg(msg *message) {
-	for m := range msg.incoming {
-		if cfg.Rcon.QlZmqShowOnConsole {
-			if msg.msgType == smtMonitor {
-				fmt.Printf("[Monitor] %s\n", m)
-			} else if msg.msgType == smtRcon {
-				fmt.Printf("[Rcon] %s\n", m)
-			}
+// Replaced by tests, which have no QL server to talk to
+var sendRconAction = (*qlZmqSocket).doRconAction
+
+func (srv *qlServer) send(action string) error {
+	srv.mutex.Lock()
+	rconsock := srv.rcon
+	srv.mutex.Unlock()
+	if rconsock == nil {
+		return fmt.Errorf("No RCON socket for server '%s' yet", srv.id)
+	}
+	sendRconAction(rconsock, action)
+	return nil
+}
+
+func newMessage(msgtype qlSocketOrMsgType, serverid, contents string) *message {
+	return &message{
+		contents:     contents,
+		msgType:      msgtype,
+		serverId:     serverid,
+		timeReceived: time.Now(),
+	}
+}
+
+func readZmqSocketMsg(incoming <-chan *message) {
+	for msg := range incoming {
+		var msgtype string
+		switch msg.msgType {
+		case smtRcon:
+			msgtype = bridge.MsgRcon
+		case smtMonitor:
+			msgtype = bridge.MsgMonitor
+		case smtStatus:
+			msgtype = bridge.MsgStatus
+		case smtPlayers:
+			msgtype = bridge.MsgPlayers
+		case smtStats:
+			msgtype = bridge.MsgStats
+		}
+		if currentCfg().Rcon.QlZmqShowOnConsole && msg.payload == nil {
+			fmt.Printf("[%s %s] %s\n", msgtype, msg.serverId, msg.contents)
 		}
 		// send to web ui
-		bridge.MessageBridge.RconToWeb <- []byte(m)
+		bridge.MessageBridge.RconToWeb <- &bridge.Message{
+			Type:     msgtype,
+			ServerId: msg.serverId,
+			Time:     msg.timeReceived,
+			Data:     []byte(msg.contents),
+			Payload:  msg.payload,
+		}
 	}
 }
 
-func startSocketMonitor(polltimeout time.Duration) {
-	// Create sockets here so that polling will not need a lock
-	qlzSockets, err := createSockets()
+func (srv *qlServer) playersMessage() *message {
+	m := newMessage(smtPlayers, srv.id, "")
+	m.payload = srv.players.list()
+	return m
+}
+
+// Reply to the web client that sent m without blocking the caller; the
+// bridge may itself be waiting to hand us the next message.
+func replyToWeb(m *bridge.Message, msgtype string, data []byte) {
+	reply := bridge.NewMessage(msgtype, m.ServerId, data)
+	reply.CorrelationId = m.CorrelationId
+	reply.Client = m.Client
+	go func() {
+		bridge.MessageBridge.RconToWeb <- reply
+	}()
+}
+
+// Create the server's sockets and start polling them
+func (srv *qlServer) start() error {
+	qlzSockets, err := createSockets(srv)
 	if err != nil {
-		log.Fatalf("FATAL: error when attempting to create sockets: %s", err)
+		return fmt.Errorf("Unable to create sockets for server '%s': %s",
+			srv.id, err)
+	}
+	srv.stop = make(chan struct{})
+	srv.stopped = make(chan struct{})
+	srv.status.polled(true)
+	go startSocketMonitor(srv, qlzSockets)
+	return nil
+}
+
+// Stop polling and close the server's sockets. The command in flight, if
+// any, fails; queued commands are kept.
+func (srv *qlServer) shutdown() {
+	if srv.stop == nil {
+		// not running, e.g. restarting it failed
+		return
 	}
-	// Incoming rcon messages from web
-	for _, s := range qlzSockets {
-		if s.typeQlSocket == smtRcon {
-			go ListenForRconMessagesFromWeb(s)
+	close(srv.stop)
+	<-srv.stopped
+	srv.stop = nil
+}
+
+func closeSockets(srv *qlServer, qlzSockets []*qlZmqSocket) {
+	srv.mutex.Lock()
+	srv.rcon = nil
+	srv.mutex.Unlock()
+	for _, qzs := range qlzSockets {
+		if qzs.typeQlSocket == smtRcon {
+			qzs.socket.Monitor("", 0)
 		}
+		qzs.socket.SetLinger(0)
+		qzs.socket.Close()
+	}
+	if srv.inFlight != nil {
+		replyToWeb(srv.inFlight.request, bridge.MsgError,
+			[]byte(fmt.Sprintf("Connection to server '%s' was closed", srv.id)))
+		srv.inFlight = nil
 	}
+}
 
+// Sockets are created by start() and handed over here; from then on only
+// this goroutine touches them
+func startSocketMonitor(srv *qlServer, qlzSockets []*qlZmqSocket) {
 	// Messages received from polled sockets to be read/processed
-	socketMsg := &message{timeReceived: time.Now(), incoming: make(chan string)}
-	go readZmqSocketMsg(socketMsg)
+	incoming := make(chan *message)
+	go readZmqSocketMsg(incoming)
 
 	// Sockets for zmq poller (*zmq4.Socket)
 	var zRconSocket *zmq.Socket
 	var zMonitorSocket *zmq.Socket
+	var zStatsSocket *zmq.Socket
 	for _, qzs := range qlzSockets {
 		if qzs.typeQlSocket == smtRcon {
+			// Incoming rcon messages from web
+			srv.mutex.Lock()
+			srv.rcon = qzs
+			srv.mutex.Unlock()
 			zRconSocket = qzs.socket
 		} else if qzs.typeQlSocket == smtMonitor {
 			zMonitorSocket = qzs.socket
+		} else if qzs.typeQlSocket == smtStats {
+			zStatsSocket = qzs.socket
 		}
 	}
 
 	poller := zmq.NewPoller()
 	poller.Add(zRconSocket, zmq.POLLIN)
 	poller.Add(zMonitorSocket, zmq.POLLIN)
+	if zStatsSocket != nil {
+		poller.Add(zStatsSocket, zmq.POLLIN)
+	}
 
 	// Incoming messages from ZMQ
 	for {
+		select {
+		case <-srv.stop:
+			closeSockets(srv, qlzSockets)
+			close(incoming)
+			close(srv.stopped)
+			return
+		default:
+		}
+		started := time.Now()
+		srv.sendNextCommand()
+		polltimeout := currentCfg().Rcon.QlZmqRconPollTimeout * time.Millisecond
 		zmqSockets, _ := poller.Poll(polltimeout)
+		if len(zmqSockets) == 0 && srv.players.flush() {
+			incoming <- srv.playersMessage()
+		}
+		srv.checkCommandDone(time.Now())
 		for _, zmqsock := range zmqSockets {
 			switch z := zmqsock.Socket; z {
 			case zRconSocket:
 				msg, err := z.Recv(0)
 				if err != nil {
-					fmt.Printf("Error polling msg from rcon socket: %s\n", err)
+					fmt.Printf("Error polling msg from rcon socket (%s): %s\n",
+						srv.id, err)
 					continue
 				}
 				if len(msg) != 0 {
-					socketMsg.incoming <- msg
-					socketMsg.msgType = smtRcon
-					socketMsg.timeReceived = time.Now()
+					// Responses go back to whoever sent the command;
+					// everything else is broadcast
+					if !srv.collectOutput(msg) {
+						incoming <- newMessage(smtRcon, srv.id, msg)
+					}
+					if srv.players.feed(msg) {
+						incoming <- srv.playersMessage()
+					}
 				}
 			case zMonitorSocket:
 				ev, adr, _, err := z.RecvEvent(0)
 				if err != nil {
-					fmt.Printf("Error polling msg from monitor socket: %s\n",
-						err)
+					fmt.Printf("Error polling msg from monitor socket (%s): %s\n",
+						srv.id, err)
+					continue
+				}
+				monitorEvents.Inc(srv.id, ev.String())
+				incoming <- newMessage(smtMonitor, srv.id,
+					fmt.Sprintf("%s %s", ev, adr))
+				srv.handleMonitorEvent(ev, incoming)
+			case zStatsSocket:
+				msg, err := z.Recv(0)
+				if err != nil {
+					fmt.Printf("Error polling msg from stats socket (%s): %s\n",
+						srv.id, err)
+					continue
+				}
+				ev, err := decodeStatsEvent(msg)
+				if err != nil {
+					fmt.Printf("%s (%s)\n", err, srv.id)
 					continue
 				}
-				socketMsg.incoming <- fmt.Sprintf("%s %s", ev, adr)
-				socketMsg.msgType = smtMonitor
-				socketMsg.timeReceived = time.Now()
+				m := newMessage(smtStats, srv.id, msg)
+				m.payload = ev
+				incoming <- m
 			}
 		}
+		pollDuration.Observe(time.Since(started).Seconds(), srv.id)
+		srv.status.polled(srv.inFlight == nil)
 	}
 }
 
-// listen for messages from web ui to forward to rcon(zmq)
-func ListenForRconMessagesFromWeb(rconsock *qlZmqSocket) {
+// listen for messages from web ui to forward to the right server's rcon(zmq)
+func ListenForRconMessagesFromWeb() {
 	for m := range bridge.MessageBridge.OutToRcon {
-		rconsock.doRconAction(string(m))
+		serversMutex.RLock()
+		srv, ok := servers[m.ServerId]
+		serversMutex.RUnlock()
+		if !ok {
+			replyToWeb(m, bridge.MsgError,
+				[]byte(fmt.Sprintf("Unknown server '%s'", m.ServerId)))
+			continue
+		}
+		if err := srv.queueCommand(m); err != nil {
+			replyToWeb(m, bridge.MsgError, []byte(err.Error()))
+		}
 	}
 }
 
@@ -205,7 +450,22 @@ func Start() {
 	if err != nil {
 		log.Fatalf("FATAL: unable to read RCON configuration file: %s", err)
 	}
+	zmqContext, err = zmq.NewContext()
+	if err != nil {
+		log.Fatalf("FATAL: unable to create ZMQ context: %s", err)
+	}
 
-	go startSocketMonitor(cfg.Rcon.QlZmqRconPollTimeout * time.Millisecond)
-	log.Printf("webqlrcon %s: Launched RCON interface\n", config.Version)
+	for _, s := range cfg.Rcon.Servers {
+		srv := newQlServer(s)
+		servers[s.Id] = srv
+		serverOrder = append(serverOrder, s.Id)
+	}
+	for _, srv := range servers {
+		if err := srv.start(); err != nil {
+			log.Fatalf("FATAL: %s", err)
+		}
+	}
+	go ListenForRconMessagesFromWeb()
+	log.Printf("webqlrcon %s: Launched RCON interface for %d server(s)\n",
+		config.Version, len(servers))
 }
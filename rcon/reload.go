@@ -0,0 +1,153 @@
+// reload.go - Applying a re-read RCON configuration without a restart.
+package rcon
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"webqlrc/bridge"
+	"webqlrc/config"
+)
+
+var reloadMutex sync.Mutex
+
+// Apply a re-read RCON configuration. Timeouts and console echo take effect
+// immediately; servers that were added or removed are started or stopped,
+// and only servers whose connection settings changed are reconnected.
+// Returns a description of each change that was applied.
+func Reload(newcfg *config.Config) ([]string, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	var applied []string
+	var failed []string
+	old := currentCfg().Rcon
+	nr := newcfg.Rcon
+	if old.QlZmqRconPollTimeout != nr.QlZmqRconPollTimeout {
+		applied = append(applied, fmt.Sprintf("RCON poll timeout: %dms",
+			nr.QlZmqRconPollTimeout))
+	}
+	if old.QlZmqResponseQuietPeriod != nr.QlZmqResponseQuietPeriod ||
+		old.QlZmqResponseTimeout != nr.QlZmqResponseTimeout {
+		applied = append(applied, fmt.Sprintf(
+			"RCON response quiet period/timeout: %dms/%dms",
+			nr.QlZmqResponseQuietPeriod, nr.QlZmqResponseTimeout))
+	}
+	if old.QlZmqShowOnConsole != nr.QlZmqShowOnConsole {
+		applied = append(applied, fmt.Sprintf("RCON console echo: %t",
+			nr.QlZmqShowOnConsole))
+	}
+	// The reconnect interval is fixed when a socket connects
+	reconnectAll := old.QlZmqReconnectInterval != nr.QlZmqReconnectInterval ||
+		old.QlZmqReconnectMaxInterval != nr.QlZmqReconnectMaxInterval
+	if reconnectAll {
+		applied = append(applied, fmt.Sprintf(
+			"RCON reconnect interval: %dms-%dms (all servers reconnected)",
+			nr.QlZmqReconnectInterval, nr.QlZmqReconnectMaxInterval))
+	}
+
+	cfgMutex.Lock()
+	cfg = newcfg
+	cfgMutex.Unlock()
+
+	serversMutex.RLock()
+	current := make(map[string]*qlServer, len(servers))
+	for id, srv := range servers {
+		current[id] = srv
+	}
+	serversMutex.RUnlock()
+
+	for id, srv := range current {
+		if nr.Server(id) != nil {
+			continue
+		}
+		srv.shutdown()
+		srv.remove()
+		serversMutex.Lock()
+		delete(servers, id)
+		serverOrder = removeId(serverOrder, id)
+		serversMutex.Unlock()
+		applied = append(applied, fmt.Sprintf("Removed server '%s'", id))
+	}
+
+	order := make([]string, 0, len(nr.Servers))
+	for _, s := range nr.Servers {
+		srv, ok := current[s.Id]
+		if !ok {
+			srv = newQlServer(s)
+			if err := srv.start(); err != nil {
+				failed = append(failed, err.Error())
+				continue
+			}
+			serversMutex.Lock()
+			servers[s.Id] = srv
+			serversMutex.Unlock()
+			order = append(order, s.Id)
+			applied = append(applied, fmt.Sprintf("Added server '%s'", s.Id))
+			continue
+		}
+		order = append(order, s.Id)
+		if !reconnectAll && !srv.settingsChanged(s) {
+			continue
+		}
+		srv.shutdown()
+		srv.configure(s)
+		srv.generation++
+		srv.status.set(stateConnecting)
+		go func(id string) {
+			bridge.MessageBridge.RconToWeb <- bridge.NewMessage(bridge.MsgStatus,
+				id, []byte(stateConnecting.String()))
+		}(s.Id)
+		if err := srv.start(); err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		if !reconnectAll {
+			applied = append(applied, fmt.Sprintf("Reconnected server '%s'",
+				s.Id))
+		}
+	}
+	serversMutex.Lock()
+	serverOrder = order
+	serversMutex.Unlock()
+
+	if len(failed) > 0 {
+		return applied, fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return applied, nil
+}
+
+func removeId(ids []string, id string) []string {
+	kept := make([]string, 0, len(ids))
+	for _, i := range ids {
+		if i != id {
+			kept = append(kept, i)
+		}
+	}
+	return kept
+}
+
+func (srv *qlServer) settingsChanged(s *config.RconServerConfig) bool {
+	next := &qlServer{}
+	next.configure(s)
+	return next.address != srv.address || next.password != srv.password ||
+		next.statsAddress != srv.statsAddress ||
+		next.statsPassword != srv.statsPassword
+}
+
+// Fail every command still queued for a server that no longer exists
+func (srv *qlServer) remove() {
+	srv.mutex.Lock()
+	srv.removed = true
+	srv.mutex.Unlock()
+	forgetServerMetrics(srv.id)
+	for {
+		select {
+		case m := <-srv.commands:
+			replyToWeb(m, bridge.MsgError,
+				[]byte(fmt.Sprintf("Server '%s' was removed", srv.id)))
+		default:
+			return
+		}
+	}
+}
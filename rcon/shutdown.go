@@ -0,0 +1,93 @@
+// shutdown.go - Finishing queued commands and closing the ZMQ connections
+// when webqlrc exits.
+package rcon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const drainCheckInterval = 50 * time.Millisecond
+
+func allServers() []*qlServer {
+	serversMutex.RLock()
+	defer serversMutex.RUnlock()
+	list := make([]*qlServer, 0, len(servers))
+	for _, srv := range servers {
+		list = append(list, srv)
+	}
+	return list
+}
+
+func (srv *qlServer) busy() bool {
+	srv.status.mutex.Lock()
+	defer srv.status.mutex.Unlock()
+	return !srv.status.idle || len(srv.commands) > 0
+}
+
+// Wait until the commands already passed from the web have been answered or
+// have timed out
+func Drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for {
+		busy := 0
+		for _, srv := range allServers() {
+			if srv.busy() {
+				busy++
+			}
+		}
+		if busy == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Commands for %d server(s) were not finished: %s",
+				busy, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close every server's DEALER, monitor and stats sockets, then terminate the
+// ZMQ context
+func Shutdown(ctx context.Context) error {
+	// Servers can't be restarted by a reload from here on
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, srv := range allServers() {
+			wg.Add(1)
+			go func(srv *qlServer) {
+				defer wg.Done()
+				srv.shutdown()
+			}(srv)
+		}
+		wg.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		return fmt.Errorf("Timed out closing ZMQ sockets: %s", ctx.Err())
+	}
+
+	terminated := make(chan error, 1)
+	go func() {
+		terminated <- zmqContext.Term()
+	}()
+	select {
+	case err := <-terminated:
+		if err != nil {
+			return fmt.Errorf("Unable to terminate ZMQ context: %s", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Timed out terminating ZMQ context: %s", ctx.Err())
+	}
+}
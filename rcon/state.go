@@ -0,0 +1,215 @@
+// state.go - RCON connection state tracking, driven by ZMQ monitor events.
+package rcon
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+type connState int
+
+const (
+	stateConnecting   connState = 0
+	stateConnected    connState = 1
+	stateDisconnected connState = 2
+	stateAuthFailed   connState = 3
+)
+
+// A poll loop that hasn't finished an iteration for this long, or for this
+// many poll timeouts if they are longer, has stalled
+const (
+	minPollStallTimeout = 10 * time.Second
+	pollStallTimeouts   = 10
+)
+
+type connStatus struct {
+	mutex         sync.Mutex
+	state         connState
+	since         time.Time
+	reconnects    int
+	everConnected bool
+	// when the poll loop last finished an iteration, and whether it had no
+	// command in flight then
+	lastPoll time.Time
+	idle     bool
+}
+
+func newConnStatus() *connStatus {
+	return &connStatus{state: stateConnecting, since: time.Now()}
+}
+
+func (s connState) String() string {
+	switch s {
+	case stateConnecting:
+		return "connecting"
+	case stateConnected:
+		return "connected"
+	case stateDisconnected:
+		return "disconnected"
+	case stateAuthFailed:
+		return "auth-failed"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// Returns true if the state actually changed.
+func (cs *connStatus) set(state connState) bool {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.state == state {
+		return false
+	}
+	if state == stateConnected {
+		if cs.everConnected {
+			cs.reconnects++
+		}
+		cs.everConnected = true
+	}
+	cs.state = state
+	cs.since = time.Now()
+	return true
+}
+
+func (cs *connStatus) get() connState {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.state
+}
+
+func (cs *connStatus) polled(idle bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.lastPoll = time.Now()
+	cs.idle = idle
+}
+
+// Connection state of one server, as reported to the web and API
+type ServerStatus struct {
+	Id         string    `json:"id"`
+	State      string    `json:"state"`
+	Since      time.Time `json:"since"`
+	Reconnects int       `json:"reconnects"`
+}
+
+func (srv *qlServer) serverStatus() *ServerStatus {
+	srv.status.mutex.Lock()
+	defer srv.status.mutex.Unlock()
+	return &ServerStatus{
+		Id:         srv.id,
+		State:      srv.status.state.String(),
+		Since:      srv.status.since,
+		Reconnects: srv.status.reconnects,
+	}
+}
+
+// Whether a server can be used, as reported by the readiness check
+type ServerHealth struct {
+	Id          string    `json:"id"`
+	State       string    `json:"state"`
+	LastPoll    time.Time `json:"last_poll"`
+	PollStalled bool      `json:"poll_stalled"`
+	Ready       bool      `json:"ready"`
+	Problem     string    `json:"problem,omitempty"`
+}
+
+func pollStallTimeout() time.Duration {
+	polltimeout := currentCfg().Rcon.QlZmqRconPollTimeout * time.Millisecond
+	if stall := pollStallTimeouts * polltimeout; stall > minPollStallTimeout {
+		return stall
+	}
+	return minPollStallTimeout
+}
+
+func (srv *qlServer) health(now time.Time) *ServerHealth {
+	stallTimeout := pollStallTimeout()
+	srv.status.mutex.Lock()
+	defer srv.status.mutex.Unlock()
+	h := &ServerHealth{
+		Id:          srv.id,
+		State:       srv.status.state.String(),
+		LastPoll:    srv.status.lastPoll,
+		PollStalled: now.Sub(srv.status.lastPoll) > stallTimeout,
+	}
+	switch {
+	case h.PollStalled:
+		h.Problem = fmt.Sprintf("poll loop has not run since %s",
+			h.LastPoll.Format(time.RFC3339))
+	case srv.status.state != stateConnected:
+		h.Problem = "RCON socket is not connected"
+	default:
+		h.Ready = true
+	}
+	return h
+}
+
+// Health of every server, in configuration order
+func Health() []*ServerHealth {
+	serversMutex.RLock()
+	defer serversMutex.RUnlock()
+	now := time.Now()
+	health := make([]*ServerHealth, 0, len(serverOrder))
+	for _, id := range serverOrder {
+		if srv, ok := servers[id]; ok {
+			health = append(health, srv.health(now))
+		}
+	}
+	return health
+}
+
+// Status of every server, in configuration order
+func Servers() []*ServerStatus {
+	serversMutex.RLock()
+	defer serversMutex.RUnlock()
+	statuses := make([]*ServerStatus, 0, len(serverOrder))
+	for _, id := range serverOrder {
+		if srv, ok := servers[id]; ok {
+			statuses = append(statuses, srv.serverStatus())
+		}
+	}
+	return statuses
+}
+
+// Map a monitor event to the connection state it implies. The second return
+// value is false for events that don't affect the connection state.
+// EVENT_CONNECTED only means the TCP connection is up; QL hasn't accepted
+// the password until the handshake succeeds.
+func stateForEvent(ev zmq.Event) (connState, bool) {
+	switch ev {
+	case zmq.EVENT_HANDSHAKE_SUCCEEDED:
+		return stateConnected, true
+	case zmq.EVENT_CONNECTED, zmq.EVENT_CONNECT_DELAYED,
+		zmq.EVENT_CONNECT_RETRIED:
+		return stateConnecting, true
+	case zmq.EVENT_DISCONNECTED, zmq.EVENT_CLOSED:
+		return stateDisconnected, true
+	case zmq.EVENT_HANDSHAKE_FAILED_AUTH:
+		return stateAuthFailed, true
+	}
+	return 0, false
+}
+
+// Update the connection state for a monitor event. Re-register with QL
+// whenever the handshake succeeds; the server forgets about us each time it
+// restarts.
+func (srv *qlServer) handleMonitorEvent(ev zmq.Event, out chan<- *message) {
+	state, ok := stateForEvent(ev)
+	if !ok {
+		return
+	}
+	// Auth failures are followed by a disconnect and a retry; keep reporting
+	// auth-failed until a handshake succeeds
+	if state != stateConnected && srv.status.get() == stateAuthFailed {
+		return
+	}
+	if !srv.status.set(state) {
+		return
+	}
+	if state == stateConnected {
+		fmt.Printf("Registering connection to %s\n", srv.address)
+		srv.send("register")
+	}
+	out <- newMessage(smtStatus, srv.id, state.String())
+}
@@ -0,0 +1,41 @@
+package rcon
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+	"webqlrc/config"
+)
+
+func TestPollStalled(t *testing.T) {
+	srv, _ := testServer(t)
+	srv.status.set(stateConnected)
+	tests := []struct {
+		pollTimeout int
+		since       time.Duration
+		stalled     bool
+	}{
+		{50, 10 * time.Second, false},
+		{50, 10*time.Second + 1, true},
+		// slow polls aren't taken for a stall
+		{5000, 49 * time.Second, false},
+		{5000, 50*time.Second + 1, true},
+	}
+	for _, test := range tests {
+		var c config.Config
+		if err := json.Unmarshal([]byte(`{"Rcon": {}}`), &c); err != nil {
+			t.Fatal(err)
+		}
+		c.Rcon.QlZmqRconPollTimeout = time.Duration(test.pollTimeout)
+		cfgMutex.Lock()
+		cfg = &c
+		cfgMutex.Unlock()
+
+		lastPoll := srv.status.lastPoll
+		h := srv.health(lastPoll.Add(test.since))
+		if h.PollStalled != test.stalled || h.Ready == test.stalled {
+			t.Errorf("poll timeout %dms, last poll %s ago: %+v",
+				test.pollTimeout, test.since, h)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// stats.go - Decoding of the events published on QL's ZMQ stats socket.
+package rcon
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	StatsPlayerConnect    = "PLAYER_CONNECT"
+	StatsPlayerDisconnect = "PLAYER_DISCONNECT"
+	StatsPlayerKill       = "PLAYER_KILL"
+	StatsPlayerDeath      = "PLAYER_DEATH"
+	StatsRoundOver        = "ROUND_OVER"
+	StatsMatchStarted     = "MATCH_STARTED"
+	StatsMatchReport      = "MATCH_REPORT"
+	StatsPlayerStats      = "PLAYER_STATS"
+)
+
+// StatsEvent is a single event from the stats publisher. Data holds one of
+// the typed structs below, or the raw JSON for event types we don't know.
+type StatsEvent struct {
+	Type string      `json:"TYPE"`
+	Data interface{} `json:"DATA"`
+}
+
+type rawStatsEvent struct {
+	Type string          `json:"TYPE"`
+	Data json.RawMessage `json:"DATA"`
+}
+
+type PlayerConnect struct {
+	MatchGuid string `json:"MATCH_GUID"`
+	Name      string `json:"NAME"`
+	SteamId   string `json:"STEAM_ID"`
+}
+
+type StatsPlayer struct {
+	Name    string `json:"NAME"`
+	SteamId string `json:"STEAM_ID"`
+	Team    int    `json:"TEAM"`
+	Weapon  string `json:"WEAPON,omitempty"`
+}
+
+type PlayerKill struct {
+	MatchGuid string       `json:"MATCH_GUID"`
+	Killer    *StatsPlayer `json:"KILLER"`
+	Victim    *StatsPlayer `json:"VICTIM"`
+	Mod       string       `json:"MOD"`
+	Round     int          `json:"ROUND"`
+	Time      int          `json:"TIME"`
+	Warmup    bool         `json:"WARMUP"`
+	Suicide   bool         `json:"SUICIDE"`
+	Teamkill  bool         `json:"TEAMKILL"`
+}
+
+type RoundOver struct {
+	MatchGuid string `json:"MATCH_GUID"`
+	Round     int    `json:"ROUND"`
+	TeamWon   string `json:"TEAM_WON"`
+	Time      int    `json:"TIME"`
+}
+
+type MatchStarted struct {
+	MatchGuid   string         `json:"MATCH_GUID"`
+	Map         string         `json:"MAP"`
+	GameType    string         `json:"GAME_TYPE"`
+	Factory     string         `json:"FACTORY"`
+	ServerTitle string         `json:"SERVER_TITLE"`
+	Players     []*StatsPlayer `json:"PLAYERS"`
+}
+
+type MatchReport struct {
+	MatchGuid    string `json:"MATCH_GUID"`
+	Map          string `json:"MAP"`
+	GameType     string `json:"GAME_TYPE"`
+	Factory      string `json:"FACTORY"`
+	ServerTitle  string `json:"SERVER_TITLE"`
+	GameLength   int    `json:"GAME_LENGTH"`
+	ExitMsg      string `json:"EXIT_MSG"`
+	Aborted      bool   `json:"ABORTED"`
+	TeamScore0   int    `json:"TSCORE0"`
+	TeamScore1   int    `json:"TSCORE1"`
+	ScoreLimit   int    `json:"SCORE_LIMIT"`
+	FirstScorer  string `json:"FIRST_SCORER"`
+	LastScorer   string `json:"LAST_SCORER"`
+	LastLeadTeam string `json:"LAST_LEAD_CHANGE_TEAM,omitempty"`
+}
+
+// Per weapon totals in PLAYER_STATS
+type WeaponStats struct {
+	Kills          int `json:"K"`
+	Deaths         int `json:"D"`
+	DamageGiven    int `json:"DG"`
+	DamageReceived int `json:"DR"`
+	Hits           int `json:"H"`
+	Shots          int `json:"S"`
+	Pickups        int `json:"P"`
+	Time           int `json:"T"`
+}
+
+type DamageStats struct {
+	Dealt int `json:"DEALT"`
+	Taken int `json:"TAKEN"`
+}
+
+type PlayerStats struct {
+	MatchGuid string                  `json:"MATCH_GUID"`
+	Name      string                  `json:"NAME"`
+	SteamId   string                  `json:"STEAM_ID"`
+	Kills     int                     `json:"KILLS"`
+	Deaths    int                     `json:"DEATHS"`
+	Score     int                     `json:"SCORE"`
+	Rank      int                     `json:"RANK"`
+	Team      int                     `json:"TEAM"`
+	PlayTime  int                     `json:"PLAY_TIME"`
+	Quit      int                     `json:"QUIT"`
+	Aborted   bool                    `json:"ABORTED"`
+	Warmup    bool                    `json:"WARMUP"`
+	Damage    *DamageStats            `json:"DAMAGE"`
+	Weapons   map[string]*WeaponStats `json:"WEAPONS"`
+}
+
+// Accuracy in percent, or 0 if no shots were fired
+func (ws *WeaponStats) Accuracy() float64 {
+	if ws.Shots == 0 {
+		return 0
+	}
+	return float64(ws.Hits) * 100 / float64(ws.Shots)
+}
+
+func decodeStatsEvent(msg string) (*StatsEvent, error) {
+	raw := &rawStatsEvent{}
+	if err := json.Unmarshal([]byte(msg), raw); err != nil {
+		return nil, fmt.Errorf("Unable to decode stats event: %s", err)
+	}
+	var data interface{}
+	switch raw.Type {
+	case StatsPlayerConnect, StatsPlayerDisconnect:
+		data = &PlayerConnect{}
+	case StatsPlayerKill, StatsPlayerDeath:
+		data = &PlayerKill{}
+	case StatsRoundOver:
+		data = &RoundOver{}
+	case StatsMatchStarted:
+		data = &MatchStarted{}
+	case StatsMatchReport:
+		data = &MatchReport{}
+	case StatsPlayerStats:
+		data = &PlayerStats{}
+	default:
+		return &StatsEvent{Type: raw.Type, Data: raw.Data}, nil
+	}
+	if err := json.Unmarshal(raw.Data, data); err != nil {
+		return nil, fmt.Errorf("Unable to decode %s stats event: %s", raw.Type,
+			err)
+	}
+	return &StatsEvent{Type: raw.Type, Data: data}, nil
+}
@@ -0,0 +1,375 @@
+// storage.go - Embedded database of match reports, player stats and
+// connection history from QL's stats publisher.
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+	"webqlrc/bridge"
+	"webqlrc/config"
+	"webqlrc/rcon"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	matchesBucket     = []byte("matches")
+	matchTimesBucket  = []byte("match_times")
+	playersBucket     = []byte("players")
+	connectionsBucket = []byte("connections")
+	db                *bolt.DB
+	// closed once the events queued before Stop was called are stored
+	stopped = make(chan struct{})
+)
+
+type Match struct {
+	Guid     string              `json:"guid"`
+	ServerId string              `json:"server_id"`
+	Started  time.Time           `json:"started"`
+	Ended    time.Time           `json:"ended"`
+	Report   *rcon.MatchReport   `json:"report,omitempty"`
+	Players  []*rcon.PlayerStats `json:"players"`
+}
+
+type Career struct {
+	SteamId  string                       `json:"steam_id"`
+	Name     string                       `json:"name"`
+	Matches  int                          `json:"matches"`
+	Kills    int                          `json:"kills"`
+	Deaths   int                          `json:"deaths"`
+	PlaySecs int                          `json:"play_secs"`
+	LastSeen time.Time                    `json:"last_seen"`
+	Weapons  map[string]*rcon.WeaponStats `json:"weapons"`
+}
+
+type Connection struct {
+	Time     time.Time `json:"time"`
+	ServerId string    `json:"server_id"`
+	Name     string    `json:"name"`
+	Event    string    `json:"event"`
+}
+
+func (c *Career) PlayTime() time.Duration {
+	return time.Duration(c.PlaySecs) * time.Second
+}
+
+func (c *Career) Ratio() float64 {
+	if c.Deaths == 0 {
+		return float64(c.Kills)
+	}
+	return float64(c.Kills) / float64(c.Deaths)
+}
+
+// Keys that sort in time order
+func timeKey(t time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+func getJSON(b *bolt.Bucket, key []byte, v interface{}) (bool, error) {
+	data := b.Get(key)
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func putJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+func loadMatch(b *bolt.Bucket, guid string, serverid string,
+	when time.Time) (*Match, error) {
+	m := &Match{}
+	found, err := getJSON(b, []byte(guid), m)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		m = &Match{Guid: guid, ServerId: serverid, Started: when}
+	}
+	return m, nil
+}
+
+func recordMatchStarted(tx *bolt.Tx, serverid string, when time.Time,
+	ms *rcon.MatchStarted) error {
+	b := tx.Bucket(matchesBucket)
+	m, err := loadMatch(b, ms.MatchGuid, serverid, when)
+	if err != nil {
+		return err
+	}
+	m.Started = when
+	return putJSON(b, []byte(m.Guid), m)
+}
+
+func recordMatchReport(tx *bolt.Tx, serverid string, when time.Time,
+	mr *rcon.MatchReport) error {
+	b := tx.Bucket(matchesBucket)
+	m, err := loadMatch(b, mr.MatchGuid, serverid, when)
+	if err != nil {
+		return err
+	}
+	m.Report = mr
+	m.Ended = when
+	if m.Started.IsZero() || m.Started.Equal(when) {
+		m.Started = when.Add(-time.Duration(mr.GameLength) * time.Second)
+	}
+	times := tx.Bucket(matchTimesBucket)
+	seq, err := times.NextSequence()
+	if err != nil {
+		return err
+	}
+	if err := times.Put(timeKey(when, seq), []byte(m.Guid)); err != nil {
+		return err
+	}
+	return putJSON(b, []byte(m.Guid), m)
+}
+
+func recordPlayerStats(tx *bolt.Tx, serverid string, when time.Time,
+	ps *rcon.PlayerStats) error {
+	if ps.Warmup {
+		return nil
+	}
+	b := tx.Bucket(matchesBucket)
+	m, err := loadMatch(b, ps.MatchGuid, serverid, when)
+	if err != nil {
+		return err
+	}
+	m.Players = append(m.Players, ps)
+	if err := putJSON(b, []byte(m.Guid), m); err != nil {
+		return err
+	}
+	if !hasSteamId(ps.SteamId) {
+		return nil
+	}
+
+	pb := tx.Bucket(playersBucket)
+	c := &Career{}
+	if _, err := getJSON(pb, []byte(ps.SteamId), c); err != nil {
+		return err
+	}
+	c.SteamId = ps.SteamId
+	c.Name = ps.Name
+	c.Matches++
+	c.Kills += ps.Kills
+	c.Deaths += ps.Deaths
+	c.PlaySecs += ps.PlayTime
+	c.LastSeen = when
+	if c.Weapons == nil {
+		c.Weapons = make(map[string]*rcon.WeaponStats)
+	}
+	for name, ws := range ps.Weapons {
+		total, ok := c.Weapons[name]
+		if !ok {
+			total = &rcon.WeaponStats{}
+			c.Weapons[name] = total
+		}
+		total.Kills += ws.Kills
+		total.Deaths += ws.Deaths
+		total.DamageGiven += ws.DamageGiven
+		total.DamageReceived += ws.DamageReceived
+		total.Hits += ws.Hits
+		total.Shots += ws.Shots
+		total.Pickups += ws.Pickups
+		total.Time += ws.Time
+	}
+	return putJSON(pb, []byte(c.SteamId), c)
+}
+
+func recordConnection(tx *bolt.Tx, serverid string, when time.Time,
+	evtype string, pc *rcon.PlayerConnect) error {
+	cb, err := tx.Bucket(connectionsBucket).CreateBucketIfNotExists(
+		[]byte(pc.SteamId))
+	if err != nil {
+		return err
+	}
+	seq, err := cb.NextSequence()
+	if err != nil {
+		return err
+	}
+	event := "connect"
+	if evtype == rcon.StatsPlayerDisconnect {
+		event = "disconnect"
+	}
+	return putJSON(cb, timeKey(when, seq), &Connection{
+		Time:     when,
+		ServerId: serverid,
+		Name:     pc.Name,
+		Event:    event,
+	})
+}
+
+// Bots have no SteamID, or 0, so there is no career or connection history
+// to file their stats under. Their stats are still kept with the match.
+func hasSteamId(steamid string) bool {
+	return steamid != "" && steamid != "0"
+}
+
+func record(msg *bridge.Message) error {
+	ev, ok := msg.Payload.(*rcon.StatsEvent)
+	if !ok {
+		return nil
+	}
+	if pc, ok := ev.Data.(*rcon.PlayerConnect); ok && !hasSteamId(pc.SteamId) {
+		return nil
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		switch data := ev.Data.(type) {
+		case *rcon.MatchStarted:
+			return recordMatchStarted(tx, msg.ServerId, msg.Time, data)
+		case *rcon.MatchReport:
+			return recordMatchReport(tx, msg.ServerId, msg.Time, data)
+		case *rcon.PlayerStats:
+			return recordPlayerStats(tx, msg.ServerId, msg.Time, data)
+		case *rcon.PlayerConnect:
+			return recordConnection(tx, msg.ServerId, msg.Time, ev.Type, data)
+		}
+		return nil
+	})
+}
+
+// A nil message from Stop ends the loop
+func storeStats(stats <-chan *bridge.Message) {
+	for msg := range stats {
+		if msg == nil {
+			close(stopped)
+			return
+		}
+		if err := record(msg); err != nil {
+			log.Printf("Unable to store stats event from '%s': %s",
+				msg.ServerId, err)
+		}
+	}
+}
+
+// Most recent matches first
+func Matches(limit int) ([]*Match, error) {
+	var matches []*Match
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(matchesBucket)
+		c := tx.Bucket(matchTimesBucket).Cursor()
+		for k, guid := c.Last(); k != nil; k, guid = c.Prev() {
+			if limit > 0 && len(matches) >= limit {
+				break
+			}
+			m := &Match{}
+			found, err := getJSON(b, guid, m)
+			if err != nil {
+				return err
+			}
+			if found {
+				matches = append(matches, m)
+			}
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// Returns nil if there is no such match
+func GetMatch(guid string) (*Match, error) {
+	var m *Match
+	err := db.View(func(tx *bolt.Tx) error {
+		found := &Match{}
+		ok, err := getJSON(tx.Bucket(matchesBucket), []byte(guid), found)
+		if ok {
+			m = found
+		}
+		return err
+	})
+	return m, err
+}
+
+// Returns nil if there are no stats for the player. Connection history is
+// most recent first, up to historyLimit entries.
+func GetCareer(steamid string, historyLimit int) (*Career, []*Connection,
+	error) {
+	var career *Career
+	var history []*Connection
+	err := db.View(func(tx *bolt.Tx) error {
+		c := &Career{}
+		ok, err := getJSON(tx.Bucket(playersBucket), []byte(steamid), c)
+		if err != nil {
+			return err
+		}
+		if ok {
+			career = c
+		}
+		cb := tx.Bucket(connectionsBucket).Bucket([]byte(steamid))
+		if cb == nil {
+			return nil
+		}
+		cur := cb.Cursor()
+		for k, v := cur.Last(); k != nil; k, v = cur.Prev() {
+			if historyLimit > 0 && len(history) >= historyLimit {
+				break
+			}
+			conn := &Connection{}
+			if err := json.Unmarshal(v, conn); err != nil {
+				return err
+			}
+			history = append(history, conn)
+		}
+		return nil
+	})
+	return career, history, err
+}
+
+func Start() error {
+	var err error
+	fpath := config.FilePath(config.StatsDatabaseFilename)
+	db, err = bolt.Open(fpath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("Unable to open stats database '%s': %s", fpath, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{matchesBucket, matchTimesBucket,
+			playersBucket, connectionsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to initialize stats database: %s", err)
+	}
+	go storeStats(bridge.MessageBridge.StatsToStorage)
+	log.Printf("webqlrcon %s: Opened stats database '%s'\n", config.Version,
+		fpath)
+	return nil
+}
+
+// Store the stats events still queued in the bridge, then close the
+// database
+func Stop(ctx context.Context) error {
+	if db == nil {
+		return nil
+	}
+	select {
+	case bridge.MessageBridge.StatsToStorage <- nil:
+	case <-ctx.Done():
+		return fmt.Errorf("Timed out queueing the last stats events: %s",
+			ctx.Err())
+	}
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return fmt.Errorf("Timed out storing the last stats events: %s",
+			ctx.Err())
+	}
+	if err := db.Close(); err != nil {
+		return fmt.Errorf("Unable to close stats database: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"webqlrc/bridge"
+	"webqlrc/config"
+	"webqlrc/rcon"
+)
+
+func statsMessage(evtype string, data interface{}) *bridge.Message {
+	m := bridge.NewMessage(bridge.MsgStats, "duel", nil)
+	m.Payload = &rcon.StatsEvent{Type: evtype, Data: data}
+	return m
+}
+
+// Events from bots are stored without failing the events around them
+func TestRecordBots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webqlrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer config.SetConfigurationDirectory(config.ConfigurationDirectory)
+	config.SetConfigurationDirectory(dir)
+	if err := Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer Stop(context.Background())
+
+	const player = "76561198000000001"
+	for _, m := range []*bridge.Message{
+		statsMessage(rcon.StatsPlayerConnect,
+			&rcon.PlayerConnect{MatchGuid: "m1", Name: "Anarki"}),
+		statsMessage(rcon.StatsPlayerConnect,
+			&rcon.PlayerConnect{MatchGuid: "m1", Name: "Sarge", SteamId: "0"}),
+		statsMessage(rcon.StatsPlayerConnect,
+			&rcon.PlayerConnect{MatchGuid: "m1", Name: "Mr Big",
+				SteamId: player}),
+		statsMessage(rcon.StatsPlayerStats,
+			&rcon.PlayerStats{MatchGuid: "m1", Name: "Anarki", Kills: 3}),
+		statsMessage(rcon.StatsPlayerStats,
+			&rcon.PlayerStats{MatchGuid: "m1", Name: "Mr Big",
+				SteamId: player, Kills: 5}),
+	} {
+		if err := record(m); err != nil {
+			t.Fatalf("%s: %s", m.Payload.(*rcon.StatsEvent).Type, err)
+		}
+	}
+
+	match, err := GetMatch("m1")
+	if err != nil || match == nil || len(match.Players) != 2 {
+		t.Fatalf("match = %+v, %v, want both players", match, err)
+	}
+	career, history, err := GetCareer(player, 0)
+	if err != nil || career == nil || career.Kills != 5 || len(history) != 1 {
+		t.Errorf("career = %+v, %+v, %v", career, history, err)
+	}
+	for _, steamid := range []string{"", "0"} {
+		career, history, err := GetCareer(steamid, 0)
+		if err != nil || career != nil || len(history) != 0 {
+			t.Errorf("bot %q career = %+v, %+v, %v", steamid, career, history,
+				err)
+		}
+	}
+}
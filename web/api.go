@@ -0,0 +1,174 @@
+// api.go - Authenticated REST API for running rcon commands.
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"webqlrc/audit"
+	"webqlrc/bridge"
+	"webqlrc/config"
+	"webqlrc/rcon"
+
+	"github.com/apexskier/httpauth"
+)
+
+const (
+	apiServersRoute   = "/api/v1/servers"
+	apiServerRoute    = "/api/v1/servers/"
+	apiCommandTimeout = 30 * time.Second
+	apiMaxBodySize    = 64 * 1024
+)
+
+type apiErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type apiCommandRequest struct {
+	Command string `json:"command"`
+	Id      string `json:"id,omitempty"`
+}
+
+type apiCommandResponse struct {
+	Server   string `json:"server"`
+	Id       string `json:"id"`
+	Command  string `json:"command"`
+	Output   string `json:"output"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &apiErrorResponse{Error: err.Error()})
+}
+
+// Users authenticate with "Authorization: Bearer <token>"
+func apiUser(r *http.Request) (httpauth.UserData, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return httpauth.UserData{}, errors.New("Missing API token")
+	}
+	username, err := config.LookupAPIToken(strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		return httpauth.UserData{}, err
+	}
+	state, err := config.GetWebUserState(username)
+	if err != nil {
+		return httpauth.UserData{}, err
+	}
+	if state.Disabled {
+		return httpauth.UserData{}, fmt.Errorf("User '%s' is disabled",
+			username)
+	}
+	return webauthbackend.User(username)
+}
+
+func serveAPIServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAPIError(w, 405, errors.New("Not allowed"))
+		return
+	}
+	if _, err := apiUser(r); err != nil {
+		writeAPIError(w, 401, errors.New("Not authorized"))
+		return
+	}
+	writeJSON(w, 200, rcon.Servers())
+}
+
+// POST /api/v1/servers/{id}/command
+func serveAPIServer(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiServerRoute), "/")
+	if len(parts) != 2 || parts[1] != "command" {
+		writeAPIError(w, 404, errors.New("Not found"))
+		return
+	}
+	serverid := parts[0]
+	if r.Method != "POST" {
+		writeAPIError(w, 405, errors.New("Not allowed"))
+		return
+	}
+	user, err := apiUser(r)
+	if err != nil {
+		writeAPIError(w, 401, errors.New("Not authorized"))
+		return
+	}
+	if currentRconCfg().Rcon.Server(serverid) == nil {
+		writeAPIError(w, 404, errors.New("Unknown server"))
+		return
+	}
+	req := &apiCommandRequest{}
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body,
+		apiMaxBodySize)).Decode(req)
+	if err != nil || req.Command == "" {
+		writeAPIError(w, 400, errors.New("Body must be JSON with a command"))
+		return
+	}
+
+	authErr := authorizeCommand(user.Role, req.Command)
+	e := &audit.Entry{
+		Type:       audit.TypeCommand,
+		User:       user.Username,
+		RemoteAddr: r.RemoteAddr,
+		Server:     serverid,
+		Command:    req.Command,
+		Allowed:    authErr == nil,
+	}
+	if authErr != nil {
+		e.Reason = authErr.Error()
+	}
+	audit.Record(e)
+	if authErr != nil {
+		writeAPIError(w, 403, authErr)
+		return
+	}
+
+	client := bridge.NewDirectClient()
+	bridge.MessageBridge.Register <- client
+	defer func() {
+		bridge.MessageBridge.Unregister <- client
+	}()
+	m := bridge.NewMessage(bridge.MsgRcon, serverid, []byte(req.Command))
+	m.CorrelationId = req.Id
+	m.Client = client
+	rcon.CountCommand(user.Username, serverid)
+	bridge.MessageBridge.WebToRcon <- m
+
+	timeout := time.NewTimer(apiCommandTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case reply, ok := <-client.Send:
+			if !ok {
+				writeAPIError(w, 500, errors.New("Lost connection to RCON"))
+				return
+			}
+			if reply.Type == bridge.MsgError {
+				writeAPIError(w, 502, errors.New(string(reply.Data)))
+				return
+			}
+			result, ok := reply.Payload.(*bridge.CommandResult)
+			if !ok {
+				continue
+			}
+			writeJSON(w, 200, &apiCommandResponse{
+				Server:   serverid,
+				Id:       reply.CorrelationId,
+				Command:  result.Command,
+				Output:   result.Output,
+				TimedOut: result.TimedOut,
+			})
+			return
+		case <-timeout.C:
+			writeAPIError(w, 504, errors.New("Timed out waiting for a response"))
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// authorize.go - Role based checks on commands sent from the web UI.
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// QL's console runs each ';' or newline separated part as its own command,
+// so every part must be allowed on its own.
+func splitCommands(cmd string) []string {
+	var names []string
+	for _, part := range strings.FieldsFunc(cmd, func(r rune) bool {
+		return r == ';' || r == '\n' || r == '\r'
+	}) {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		names = append(names, commandName(part))
+	}
+	return names
+}
+
+// The name QL runs for one command: its first token, without the quotes QL
+// strips. As in QL's tokenizer, a quote also ends an unquoted token.
+func commandName(part string) string {
+	// commands may be written as /cmd or \cmd
+	name := strings.TrimLeft(strings.TrimSpace(part), "/\\")
+	if strings.HasPrefix(name, `"`) {
+		name = name[1:]
+		if i := strings.IndexByte(name, '"'); i >= 0 {
+			name = name[:i]
+		}
+	} else if i := strings.IndexFunc(name, func(r rune) bool {
+		return r == '"' || r <= ' '
+	}); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ToLower(strings.TrimLeft(name, "/\\"))
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func authorizeCommand(role, cmd string) error {
+	perms, ok := currentCfg().Web.WebRolePermissions[role]
+	if !ok {
+		return fmt.Errorf("Role '%s' is not allowed to send commands", role)
+	}
+	for _, name := range splitCommands(cmd) {
+		if matchesAny(perms.Deny, name) || !matchesAny(perms.Allow, name) {
+			return fmt.Errorf("Role '%s' is not allowed to use '%s'", role,
+				name)
+		}
+	}
+	return nil
+}
+
+// Browsers always send an Origin header with websocket requests; check it so
+// that other sites can't use a logged in admin's cookies to open a websocket.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// not a browser
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	allowedOrigins := currentCfg().Web.WebAllowedOrigins
+	if len(allowedOrigins) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range allowedOrigins {
+		if strings.EqualFold(allowed, origin) ||
+			strings.EqualFold(allowed, u.Host) {
+			return true
+		}
+	}
+	return false
+}
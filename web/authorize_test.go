@@ -0,0 +1,63 @@
+package web
+
+import (
+	"encoding/json"
+	"testing"
+	"webqlrc/config"
+)
+
+const testWebConfig = `{"Web": {"WebRolePermissions": {
+	"admin": {"Allow": ["*"]},
+	"moderator": {
+		"Allow": ["say", "kick", "status"],
+		"Deny": ["quit", "map", "zmq_*"]
+	},
+	"viewer": {}
+}}}`
+
+func TestAuthorizeCommand(t *testing.T) {
+	var c config.Config
+	if err := json.Unmarshal([]byte(testWebConfig), &c); err != nil {
+		t.Fatal(err)
+	}
+	cfgMutex.Lock()
+	cfg = &c
+	cfgMutex.Unlock()
+
+	tests := []struct {
+		role    string
+		cmd     string
+		allowed bool
+	}{
+		{"admin", "quit", true},
+		{"admin", "map campgrounds; quit", true},
+		{"moderator", "say hello", true},
+		{"moderator", "/say hello", true},
+		{"moderator", "\\kick 3", true},
+		{"moderator", "SAY hello", true},
+		{"moderator", "say hello; status", true},
+		{"moderator", `"say" hello`, true},
+		{"moderator", "  status  ", true},
+		{"moderator", "quit", false},
+		{"moderator", "QUIT", false},
+		{"moderator", "/quit", false},
+		{"moderator", `"quit"`, false},
+		{"moderator", `"/quit"`, false},
+		{"moderator", `/"quit"`, false},
+		{"moderator", `quit"" now`, false},
+		{"moderator", "zmq_rcon_password x", false},
+		{"moderator", "say hi; quit", false},
+		{"moderator", "say hi\nquit", false},
+		{"moderator", "say hi\r\n\"map\" campgrounds", false},
+		{"moderator", "set sv_hostname x", false},
+		{"viewer", "status", false},
+		{"nosuchrole", "status", false},
+	}
+	for _, test := range tests {
+		err := authorizeCommand(test.role, test.cmd)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("authorizeCommand(%q, %q) = %v, want allowed %v",
+				test.role, test.cmd, err, test.allowed)
+		}
+	}
+}
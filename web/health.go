@@ -0,0 +1,128 @@
+// health.go - Liveness and readiness checks, and systemd notifications.
+package web
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+	"webqlrc/config"
+	"webqlrc/rcon"
+)
+
+const (
+	healthRoute = "/healthz"
+	readyRoute  = "/readyz"
+)
+
+type readiness struct {
+	Ready   bool                 `json:"ready"`
+	Servers []*rcon.ServerHealth `json:"servers"`
+}
+
+// Ready when every server's RCON socket is connected and its poll loop is
+// running
+func checkReadiness() *readiness {
+	r := &readiness{Ready: true, Servers: rcon.Health()}
+	for _, s := range r.Servers {
+		if !s.Ready {
+			r.Ready = false
+		}
+	}
+	return r
+}
+
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "405: Not allowed", 405)
+		return
+	}
+	writeJSON(w, 200, map[string]string{"status": "ok"})
+}
+
+func serveReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "405: Not allowed", 405)
+		return
+	}
+	status := 200
+	ready := checkReadiness()
+	if !ready.Ready {
+		status = 503
+	}
+	writeJSON(w, status, ready)
+}
+
+// Send a notification to systemd, if started by it with Type=notify
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("Unable to notify systemd: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("Unable to notify systemd: %s", err)
+	}
+	return nil
+}
+
+// The watchdog interval systemd expects pings at, or 0 if it isn't enabled
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" &&
+		pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Ping the systemd watchdog while every poll loop is running. A server that
+// isn't connected doesn't stop the pings; restarting webqlrc wouldn't help.
+func sdWatchdog(interval time.Duration) {
+	for range time.Tick(interval / 2) {
+		ready := 0
+		stalled := false
+		servers := rcon.Health()
+		for _, s := range servers {
+			if s.PollStalled {
+				stalled = true
+			}
+			if s.Ready {
+				ready++
+			}
+		}
+		status := fmt.Sprintf("STATUS=%d/%d servers ready", ready,
+			len(servers))
+		if !stalled {
+			status += "\nWATCHDOG=1"
+		}
+		if err := sdNotify(status); err != nil {
+			log.Printf("webqlrcon %s: %s", config.Version, err)
+		}
+	}
+}
+
+// Tell systemd the web server is up, and start the watchdog if enabled
+func sdStarted() {
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("webqlrcon %s: %s", config.Version, err)
+	}
+	if interval := sdWatchdogInterval(); interval > 0 {
+		go sdWatchdog(interval)
+	}
+}
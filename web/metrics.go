@@ -0,0 +1,57 @@
+// metrics.go - Web metrics and the /metrics route.
+package web
+
+import (
+	"log"
+	"net/http"
+	"webqlrc/config"
+	"webqlrc/metrics"
+)
+
+const metricsRoute = "/metrics"
+
+var logins = metrics.NewCounter("webqlrc_logins_total",
+	"Web login attempts, by result (success, failure or throttled).",
+	"result")
+
+func init() {
+	metrics.NewGaugeFunc("webqlrc_websocket_clients",
+		"Connected websocket clients.", func() []metrics.Sample {
+			wsConnsMutex.Lock()
+			defer wsConnsMutex.Unlock()
+			return []metrics.Sample{{Value: float64(len(wsConns))}}
+		})
+}
+
+// On the web server port, metrics are only shown to admins, who can use an
+// API token. They are shown to anyone on WebMetricsAddress.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405: Not allowed", 405)
+		return
+	}
+	user, err := apiUser(r)
+	if err != nil && r.Header.Get("Authorization") == "" {
+		user, _, err = currentUser(w, r, false)
+	}
+	if err != nil {
+		http.Error(w, "401: Not authorized", 401)
+		return
+	}
+	if !isAdmin(user) {
+		http.Error(w, "403: Forbidden", 403)
+		return
+	}
+	metrics.Handler(w, r)
+}
+
+func startMetricsListener(address string) {
+	log.Printf("webqlrcon %s: Serving metrics on http://%s%s",
+		config.Version, address, metricsRoute)
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsRoute, metrics.Handler)
+	err := newHTTPServer(address, mux).ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("FATAL: unable to start metrics listener: %s", err)
+	}
+}
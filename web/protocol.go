@@ -0,0 +1,125 @@
+// protocol.go - Websocket message framing (JSON envelope and plain text).
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"webqlrc/bridge"
+)
+
+const (
+	protocolVersion = 1
+	jsonSubprotocol = "webqlrc.json.v1"
+	textSubprotocol = "webqlrc.text"
+)
+
+// Server -> client frame
+type serverFrame struct {
+	Version int         `json:"v"`
+	Type    string      `json:"type"`
+	Server  string      `json:"server,omitempty"`
+	Time    time.Time   `json:"time"`
+	Id      string      `json:"id,omitempty"`
+	Payload interface{} `json:"payload"`
+}
+
+// Client -> server frame
+type clientFrame struct {
+	Command string `json:"command"`
+	Id      string `json:"id,omitempty"`
+	Server  string `json:"server,omitempty"`
+}
+
+func (c *webSocketConn) isPlainText() bool {
+	return c.w.Subprotocol() == textSubprotocol
+}
+
+func (c *webSocketConn) decodeMessage(msg []byte) (*bridge.Message, error) {
+	if c.isPlainText() {
+		return parseWebCommand(msg)
+	}
+	var frame clientFrame
+	if err := json.Unmarshal(msg, &frame); err != nil {
+		return nil, fmt.Errorf("Invalid message: %s", err)
+	}
+	if frame.Command == "" {
+		return nil, errors.New("Invalid message: no command given")
+	}
+	if frame.Server == "" {
+		id, err := defaultServerId()
+		if err != nil {
+			return nil, err
+		}
+		frame.Server = id
+	}
+	m := bridge.NewMessage(bridge.MsgRcon, frame.Server, []byte(frame.Command))
+	m.CorrelationId = frame.Id
+	return m, nil
+}
+
+func (c *webSocketConn) encodeMessage(msg *bridge.Message) ([]byte, error) {
+	if c.isPlainText() {
+		return formatWebMessage(msg)
+	}
+	var payload interface{} = string(msg.Data)
+	if msg.Payload != nil {
+		payload = msg.Payload
+	}
+	return json.Marshal(&serverFrame{
+		Version: protocolVersion,
+		Type:    msg.Type,
+		Server:  msg.ServerId,
+		Time:    msg.Time,
+		Id:      msg.CorrelationId,
+		Payload: payload,
+	})
+}
+
+// Commands that don't name a server go to the first configured one
+func defaultServerId() (string, error) {
+	servers := currentRconCfg().Rcon.Servers
+	if len(servers) == 0 {
+		return "", errors.New("No RCON servers are configured")
+	}
+	return servers[0].Id, nil
+}
+
+// Commands can be prefixed with "@<server id> " to pick the server they are
+// sent to. Anything else goes to the first configured server.
+func parseWebCommand(msg []byte) (*bridge.Message, error) {
+	cmd := string(msg)
+	if strings.HasPrefix(cmd, "@") {
+		fields := strings.SplitN(cmd[1:], " ", 2)
+		cmd = ""
+		if len(fields) == 2 {
+			cmd = fields[1]
+		}
+		return bridge.NewMessage(bridge.MsgRcon, fields[0], []byte(cmd)), nil
+	}
+	serverid, err := defaultServerId()
+	if err != nil {
+		return nil, err
+	}
+	return bridge.NewMessage(bridge.MsgRcon, serverid, []byte(cmd)), nil
+}
+
+func formatWebMessage(msg *bridge.Message) ([]byte, error) {
+	data := msg.Data
+	if result, ok := msg.Payload.(*bridge.CommandResult); ok {
+		return []byte(fmt.Sprintf("[%s] %s", msg.ServerId, result.Output)), nil
+	}
+	if msg.Payload != nil {
+		var err error
+		data, err = json.Marshal(msg.Payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if msg.Type == bridge.MsgRcon {
+		return []byte(fmt.Sprintf("[%s] %s", msg.ServerId, data)), nil
+	}
+	return []byte(fmt.Sprintf("[%s] %s: %s", msg.ServerId, msg.Type, data)), nil
+}
@@ -0,0 +1,49 @@
+package web
+
+import (
+	"encoding/json"
+	"testing"
+	"webqlrc/config"
+)
+
+func setRconServers(t *testing.T, servers string) {
+	var c config.Config
+	if err := json.Unmarshal([]byte(`{"Rcon": {"Servers": `+servers+`}}`),
+		&c); err != nil {
+		t.Fatal(err)
+	}
+	cfgMutex.Lock()
+	rconcfg = &c
+	cfgMutex.Unlock()
+}
+
+func TestParseWebCommand(t *testing.T) {
+	setRconServers(t, `[{"Id": "duel"}, {"Id": "ca"}]`)
+	tests := []struct {
+		msg, server, cmd string
+	}{
+		{"status", "duel", "status"},
+		{"@ca status", "ca", "status"},
+		{"@ca say hi there", "ca", "say hi there"},
+		{"@ca", "ca", ""},
+	}
+	for _, test := range tests {
+		m, err := parseWebCommand([]byte(test.msg))
+		if err != nil || m.ServerId != test.server ||
+			string(m.Data) != test.cmd {
+			t.Errorf("parseWebCommand(%q) = %+v, %v, want %q to %q", test.msg,
+				m, err, test.cmd, test.server)
+		}
+	}
+}
+
+func TestNoServers(t *testing.T) {
+	setRconServers(t, `[]`)
+	if m, err := parseWebCommand([]byte("status")); err == nil {
+		t.Errorf("command with no servers configured = %+v", m)
+	}
+	if m, err := parseWebCommand([]byte("@duel status")); err != nil ||
+		m.ServerId != "duel" {
+		t.Errorf("command naming a server = %+v, %v", m, err)
+	}
+}
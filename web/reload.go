@@ -0,0 +1,172 @@
+// reload.go - Re-reading the configuration files while running.
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"webqlrc/audit"
+	"webqlrc/config"
+	"webqlrc/rcon"
+)
+
+const reloadRoute = "/reload"
+
+type ReloadReport struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+	Error           string   `json:"error,omitempty"`
+}
+
+var reloadMutex sync.Mutex
+
+// Re-read web.conf and rcon.conf and apply what can be applied while
+// running. Nothing is changed if either file can't be read or is invalid.
+// user and remoteAddr identify who asked, for the audit log.
+func Reload(user, remoteAddr string) *ReloadReport {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	report := &ReloadReport{}
+	err := reload(report)
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	e := &audit.Entry{
+		Type:       audit.TypeReload,
+		User:       user,
+		RemoteAddr: remoteAddr,
+		Command:    "reload",
+		Allowed:    err == nil,
+		Reason:     report.Error,
+	}
+	audit.Record(e)
+
+	for _, a := range report.Applied {
+		log.Printf("webqlrcon %s: Reload: applied %s", config.Version, a)
+	}
+	for _, r := range report.RestartRequired {
+		log.Printf("webqlrcon %s: Reload: restart required for %s",
+			config.Version, r)
+	}
+	if err != nil {
+		log.Printf("webqlrcon %s: Reload failed: %s", config.Version, err)
+	}
+	return report
+}
+
+func reload(report *ReloadReport) error {
+	old := currentCfg()
+	if old == nil {
+		return errors.New("The web interface has not started yet")
+	}
+	newcfg, err := config.ReadConfig(config.WEB)
+	if err != nil {
+		return fmt.Errorf("Unable to read web configuration file: %s", err)
+	}
+	newrconcfg, err := config.ReadConfig(config.RCON)
+	if err != nil {
+		return fmt.Errorf("Unable to read RCON configuration file: %s", err)
+	}
+
+	key, err := config.ReadCookieKey()
+	if err != nil {
+		return fmt.Errorf("Unable to read cookie key: %s", err)
+	}
+
+	ow, nw := old.Web, newcfg.Web
+	applied := func(format string, a ...interface{}) {
+		report.Applied = append(report.Applied, fmt.Sprintf(format, a...))
+	}
+	restart := func(what string) {
+		report.RestartRequired = append(report.RestartRequired, what)
+	}
+	if ow.WebMaxMessageSize != nw.WebMaxMessageSize ||
+		ow.WebPongTimeout != nw.WebPongTimeout ||
+		ow.WebSendTimeout != nw.WebSendTimeout {
+		applied("websocket limits (new connections only)")
+	}
+	if !reflect.DeepEqual(ow.WebRolePermissions, nw.WebRolePermissions) {
+		applied("role permissions")
+	}
+	if !reflect.DeepEqual(ow.WebAllowedOrigins, nw.WebAllowedOrigins) {
+		applied("allowed origins: %s", strings.Join(nw.WebAllowedOrigins, ", "))
+	}
+	if ow.WebAuditMaxSize != nw.WebAuditMaxSize ||
+		ow.WebAuditMaxFiles != nw.WebAuditMaxFiles {
+		audit.SetRotation(nw.WebAuditMaxSize, nw.WebAuditMaxFiles)
+		applied("audit log rotation")
+	}
+	if ow.WebSessionLifetime != nw.WebSessionLifetime ||
+		ow.WebSessionIdleTimeout != nw.WebSessionIdleTimeout {
+		applied("session lifetimes")
+	}
+	if *ow.LoginLimits() != *nw.LoginLimits() {
+		applied("login attempt limits")
+	}
+	if ow.WebShutdownTimeout != nw.WebShutdownTimeout {
+		applied("shutdown deadline: %ds", nw.WebShutdownTimeout)
+	}
+	if ow.WebServerPort != nw.WebServerPort {
+		restart("web server port")
+	}
+	if ow.WebTLSCertFile != nw.WebTLSCertFile ||
+		ow.WebTLSKeyFile != nw.WebTLSKeyFile {
+		restart("TLS certificate")
+	}
+	if ow.WebHTTPRedirectPort != nw.WebHTTPRedirectPort {
+		restart("HTTP redirect port")
+	}
+	if ow.WebMetricsAddress != nw.WebMetricsAddress {
+		restart("metrics address")
+	}
+
+	if !bytes.Equal(key, currentCookieKey()) {
+		if err := setCookieKey(key); err != nil {
+			return fmt.Errorf("Unable to use new cookie key: %s", err)
+		}
+		// Their sessions can't be checked any more
+		closeConns(func(c *webSocketConn) bool {
+			return true
+		})
+		applied("cookie key (everyone has been logged out)")
+	}
+
+	cfgMutex.Lock()
+	cfg = newcfg
+	rconcfg = newrconcfg
+	cfgMutex.Unlock()
+
+	rconApplied, err := rcon.Reload(newrconcfg)
+	report.Applied = append(report.Applied, rconApplied...)
+	return err
+}
+
+func serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "405: Not allowed", 405)
+		return
+	}
+	user, session, err := currentUser(w, r, false)
+	if err != nil {
+		http.Error(w, "401: Not authorized", 401)
+		return
+	}
+	if !isAdmin(user) || !checkCSRF(r, session) {
+		http.Error(w, "403: Forbidden", 403)
+		return
+	}
+	report := Reload(user.Username, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	if report.Error != "" {
+		w.WriteHeader(500)
+	}
+	json.NewEncoder(w).Encode(report)
+}
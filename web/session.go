@@ -0,0 +1,367 @@
+// session.go - Login sessions that expire or can be revoked, and CSRF tokens.
+//
+// httpauth keeps the logged in user in a cookie and has no way to end a
+// session from the server. A second signed cookie records when the user
+// logged in and was last seen, so sessions that are too old, idle, ended by
+// logging out, or started before a user was disabled or had their sessions
+// revoked are rejected.
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"webqlrc/config"
+
+	"github.com/apexskier/httpauth"
+)
+
+const (
+	sessionCookieName = "webqlrc-session"
+	csrfFormField     = "csrf"
+	csrfHeader        = "X-CSRF-Token"
+)
+
+type loginSession struct {
+	username string
+	created  time.Time
+	lastSeen time.Time
+	// the same for the whole session, unlike the cookie
+	id string
+}
+
+// What the server knows about a session that its cookie doesn't
+type sessionActivity struct {
+	created time.Time
+	// commands sent over websockets don't update the cookie
+	lastSeen time.Time
+	ended    bool
+}
+
+const sessionSweepInterval = 30 * time.Second
+
+var (
+	errNoSession      = errors.New("No valid session")
+	errSessionEnded   = errors.New("Session has ended")
+	errSessionExpired = errors.New("Session has expired")
+	errSessionIdle    = errors.New("Session has been idle for too long")
+	sessionsMutex     sync.Mutex
+	sessions          = make(map[string]*sessionActivity)
+	wsConnsMutex      sync.Mutex
+	wsConns           = make(map[*webSocketConn]bool)
+)
+
+// Derived from the cookie key, which may change on reload
+var (
+	authMutex     sync.RWMutex
+	webauthorizer httpauth.Authorizer
+	sessionKey    []byte
+	cookieKey     []byte
+)
+
+func sessionLifetimes() (lifetime, idle time.Duration) {
+	webcfg := currentCfg().Web
+	return intToDuration(webcfg.WebSessionLifetime, time.Second),
+		intToDuration(webcfg.WebSessionIdleTimeout, time.Second)
+}
+
+// Use a new cookie key. Sessions signed with the old one are no longer valid.
+func setCookieKey(key []byte) error {
+	a, err := httpauth.NewAuthorizer(webauthbackend, key, "admin", webroles)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sessionCookieName))
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	webauthorizer = a
+	sessionKey = mac.Sum(nil)
+	cookieKey = key
+	return nil
+}
+
+func authorizer() httpauth.Authorizer {
+	authMutex.RLock()
+	defer authMutex.RUnlock()
+	return webauthorizer
+}
+
+func currentCookieKey() []byte {
+	authMutex.RLock()
+	defer authMutex.RUnlock()
+	return cookieKey
+}
+
+func sign(payload string) string {
+	authMutex.RLock()
+	mac := hmac.New(sha256.New, sessionKey)
+	authMutex.RUnlock()
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func startSession(w http.ResponseWriter, r *http.Request, username string) {
+	now := time.Now()
+	setSessionCookie(w, r, &loginSession{
+		username: username,
+		created:  now,
+		lastSeen: now,
+		id: fmt.Sprintf("%s|%d",
+			base64.RawURLEncoding.EncodeToString([]byte(username)),
+			now.UnixNano()),
+	})
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request,
+	s *loginSession) {
+	lifetime, _ := sessionLifetimes()
+	payload := fmt.Sprintf("%s|%d", s.id, s.lastSeen.UnixNano())
+	unsetSession(w)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    payload + "|" + sign(payload),
+		Path:     "/",
+		Expires:  s.created.Add(lifetime),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	})
+}
+
+func clearSession(w http.ResponseWriter) {
+	unsetSession(w)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// Remove the session cookie set by startSession from a response that hasn't
+// been written yet
+func unsetSession(w http.ResponseWriter) {
+	var kept []string
+	for _, c := range w.Header()["Set-Cookie"] {
+		if !strings.HasPrefix(c, sessionCookieName+"=") {
+			kept = append(kept, c)
+		}
+	}
+	w.Header()["Set-Cookie"] = kept
+}
+
+func readSession(r *http.Request) (*loginSession, error) {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, errNoSession
+	}
+	parts := strings.Split(c.Value, "|")
+	if len(parts) != 4 {
+		return nil, errNoSession
+	}
+	payload := strings.Join(parts[:3], "|")
+	if !hmac.Equal([]byte(sign(payload)), []byte(parts[3])) {
+		return nil, errNoSession
+	}
+	username, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errNoSession
+	}
+	created, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errNoSession
+	}
+	lastSeen, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, errNoSession
+	}
+	return &loginSession{
+		username: string(username),
+		created:  time.Unix(0, created),
+		lastSeen: time.Unix(0, lastSeen),
+		id:       parts[0] + "|" + parts[1],
+	}, nil
+}
+
+// Record activity that doesn't pass through currentUser
+func (s *loginSession) touch() {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	a, ok := sessions[s.id]
+	if !ok {
+		a = &sessionActivity{created: s.created}
+		sessions[s.id] = a
+	}
+	a.lastSeen = time.Now()
+}
+
+func (s *loginSession) activity() (lastSeen time.Time, ended bool) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	lastSeen = s.lastSeen
+	if a, ok := sessions[s.id]; ok {
+		if a.lastSeen.After(lastSeen) {
+			lastSeen = a.lastSeen
+		}
+		ended = a.ended
+	}
+	return lastSeen, ended
+}
+
+// Time left until the session expires unless there is more activity
+func (s *loginSession) expiresIn() time.Duration {
+	lifetime, idle := sessionLifetimes()
+	lastSeen, _ := s.activity()
+	expires := s.created.Add(lifetime)
+	if idleExpires := lastSeen.Add(idle); idleExpires.Before(expires) {
+		expires = idleExpires
+	}
+	return time.Until(expires)
+}
+
+// Check that the session hasn't expired or been ended since it started
+func (s *loginSession) check() error {
+	lifetime, idle := sessionLifetimes()
+	lastSeen, ended := s.activity()
+	now := time.Now()
+	switch {
+	case ended:
+		return errSessionEnded
+	case now.After(s.created.Add(lifetime)):
+		return errSessionExpired
+	case now.After(lastSeen.Add(idle)):
+		return errSessionIdle
+	}
+	if _, err := webauthbackend.User(s.username); err != nil {
+		return fmt.Errorf("No such web user '%s'", s.username)
+	}
+	state, err := config.GetWebUserState(s.username)
+	if err != nil {
+		return err
+	}
+	if state.Disabled {
+		return fmt.Errorf("User '%s' is disabled", s.username)
+	}
+	if !s.created.After(state.SessionsRevoked) {
+		return errNoSession
+	}
+	return nil
+}
+
+// Returns the logged in user and marks their session as active. Requests
+// whose session has ended are logged out.
+func currentUser(w http.ResponseWriter, r *http.Request,
+	redirectWithMessage bool) (httpauth.UserData, *loginSession, error) {
+	if err := authorizer().Authorize(w, r, redirectWithMessage); err != nil {
+		return httpauth.UserData{}, nil, err
+	}
+	user, err := authorizer().CurrentUser(w, r)
+	if err != nil {
+		return httpauth.UserData{}, nil, err
+	}
+	session, err := readSession(r)
+	if err == nil && session.username != user.Username {
+		err = errNoSession
+	}
+	if err == nil {
+		err = session.check()
+	}
+	if err != nil {
+		authorizer().Logout(w, r)
+		clearSession(w)
+		return httpauth.UserData{}, nil, err
+	}
+	session.lastSeen = time.Now()
+	setSessionCookie(w, r, session)
+	return user, session, nil
+}
+
+// End a session for good, e.g. when logging out
+func endSession(s *loginSession) {
+	sessionsMutex.Lock()
+	a, ok := sessions[s.id]
+	if !ok {
+		a = &sessionActivity{created: s.created}
+		sessions[s.id] = a
+	}
+	a.ended = true
+	sessionsMutex.Unlock()
+	closeConns(func(c *webSocketConn) bool {
+		return c.session.id == s.id
+	})
+}
+
+func isAdmin(user httpauth.UserData) bool {
+	return webroles[user.Role] >= webroles["admin"]
+}
+
+// Forms and requests that change something carry a token only pages served
+// to this session know
+func csrfToken(s *loginSession) string {
+	return sign("csrf|" + s.id)
+}
+
+func checkCSRF(r *http.Request, s *loginSession) bool {
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.PostFormValue(csrfFormField)
+	}
+	return checkOrigin(r) &&
+		hmac.Equal([]byte(token), []byte(csrfToken(s)))
+}
+
+func trackConn(c *webSocketConn) {
+	wsConnsMutex.Lock()
+	defer wsConnsMutex.Unlock()
+	wsConns[c] = true
+}
+
+func untrackConn(c *webSocketConn) {
+	wsConnsMutex.Lock()
+	defer wsConnsMutex.Unlock()
+	delete(wsConns, c)
+}
+
+func closeConns(match func(c *webSocketConn) bool) {
+	wsConnsMutex.Lock()
+	defer wsConnsMutex.Unlock()
+	for c := range wsConns {
+		if match(c) {
+			c.w.Close()
+		}
+	}
+}
+
+// Close the websockets of a user whose sessions have ended
+func closeUserConns(username string) {
+	closeConns(func(c *webSocketConn) bool {
+		return c.username == username
+	})
+}
+
+// Close websockets whose sessions have expired or ended, and forget sessions
+// too old to be used again
+func sweepSessions() {
+	for range time.Tick(sessionSweepInterval) {
+		closeConns(func(c *webSocketConn) bool {
+			return c.session.check() != nil
+		})
+		lifetime, _ := sessionLifetimes()
+		sessionsMutex.Lock()
+		for id, a := range sessions {
+			if time.Since(a.created) > lifetime {
+				delete(sessions, id)
+			}
+		}
+		sessionsMutex.Unlock()
+	}
+}
@@ -0,0 +1,227 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"webqlrc/config"
+)
+
+// A configuration directory with an admin and a moderator, sessions lasting
+// an hour and ending after ten idle minutes
+func testSessions(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "webqlrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SetConfigurationDirectory(dir)
+	cleanup := func() {
+		config.SetConfigurationDirectory(config.ConfigurationDirectory)
+		os.RemoveAll(dir)
+	}
+
+	var c config.Config
+	err = json.Unmarshal([]byte(`{"Web": {
+		"WebSessionLifetime": 3600,
+		"WebSessionIdleTimeout": 600
+	}}`), &c)
+	if err == nil {
+		err = setCookieKey([]byte("0123456789abcdef0123456789abcdef"))
+	}
+	if err == nil {
+		err = config.AddWebUser("alice", "secret", "admin")
+	}
+	if err == nil {
+		err = config.AddWebUser("bob", "secret", "moderator")
+	}
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	cfgMutex.Lock()
+	cfg = &c
+	cfgMutex.Unlock()
+	return cleanup
+}
+
+// A request carrying the session cookie startSession sets
+func sessionRequest(t *testing.T, username string) *http.Request {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	startSession(w, r, username)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookieName {
+		t.Fatalf("session cookies = %+v", cookies)
+	}
+	r.AddCookie(cookies[0])
+	return r
+}
+
+func TestReadSession(t *testing.T) {
+	defer testSessions(t)()
+
+	r := sessionRequest(t, "alice")
+	s, err := readSession(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.username != "alice" || s.check() != nil {
+		t.Errorf("session = %+v, check() = %v", s, s.check())
+	}
+
+	value, _ := r.Cookie(sessionCookieName)
+	parts := strings.Split(value.Value, "|")
+	later := strings.Join([]string{parts[0], parts[1],
+		"9" + parts[2], parts[3]}, "|")
+	otherUser := strings.Join([]string{"Ym9i", parts[1], parts[2], parts[3]},
+		"|")
+	badSignature := strings.Join(append(parts[:3:3], strings.Repeat("0",
+		len(parts[3]))), "|")
+	for _, v := range []string{"", "alice", later, otherUser, badSignature,
+		value.Value + "|extra"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: v})
+		if s, err := readSession(r); err != errNoSession {
+			t.Errorf("cookie %q read as %+v, %v", v, s, err)
+		}
+	}
+
+	// Sessions signed with a previous cookie key aren't accepted
+	setCookieKey([]byte("another key"))
+	if _, err := readSession(r); err != errNoSession {
+		t.Errorf("session with the old key: %v", err)
+	}
+}
+
+func TestSessionCheck(t *testing.T) {
+	defer testSessions(t)()
+
+	now := time.Now()
+	session := func(username string,
+		created, lastSeen time.Duration) *loginSession {
+		return &loginSession{
+			username: username,
+			created:  now.Add(-created),
+			lastSeen: now.Add(-lastSeen),
+			id:       username + "|" + (created + lastSeen).String(),
+		}
+	}
+	tests := []struct {
+		name    string
+		session *loginSession
+		want    error
+	}{
+		{"active", session("alice", time.Minute, 0), nil},
+		{"expired", session("alice", time.Hour+time.Second, 0),
+			errSessionExpired},
+		{"idle", session("alice", 20*time.Minute, 11*time.Minute),
+			errSessionIdle},
+	}
+	for _, test := range tests {
+		if err := test.session.check(); err != test.want {
+			t.Errorf("%s: check() = %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	// Activity the cookie doesn't know about keeps a session going
+	idle := session("alice", 20*time.Minute, 11*time.Minute)
+	idle.touch()
+	if err := idle.check(); err != nil {
+		t.Errorf("touched session: %v", err)
+	}
+
+	ended := session("alice", time.Minute, 0)
+	endSession(ended)
+	if err := ended.check(); err != errSessionEnded {
+		t.Errorf("ended session: check() = %v, want %v", err, errSessionEnded)
+	}
+
+	if err := session("nobody", time.Minute, 0).check(); err == nil {
+		t.Error("session of a user that doesn't exist accepted")
+	}
+}
+
+func TestRevokedSession(t *testing.T) {
+	defer testSessions(t)()
+
+	before := &loginSession{username: "alice", created: time.Now(),
+		lastSeen: time.Now(), id: "before"}
+	time.Sleep(time.Millisecond)
+	if err := config.RevokeWebUserSessions("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := before.check(); err != errNoSession {
+		t.Errorf("session started before revoking: check() = %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	after := &loginSession{username: "alice", created: time.Now(),
+		lastSeen: time.Now(), id: "after"}
+	if err := after.check(); err != nil {
+		t.Errorf("session started after revoking: check() = %v", err)
+	}
+}
+
+func TestDisabledUserSession(t *testing.T) {
+	defer testSessions(t)()
+
+	s := &loginSession{username: "bob", created: time.Now(),
+		lastSeen: time.Now(), id: "bob"}
+	if err := config.SetWebUserDisabled("bob", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.check(); err == nil {
+		t.Error("disabled user's session accepted")
+	}
+	if err := config.SetWebUserDisabled("bob", false); err != nil {
+		t.Fatal(err)
+	}
+	// Enabling the user again doesn't bring back sessions ended by disabling
+	if err := s.check(); err != errNoSession {
+		t.Errorf("session from before disabling: check() = %v", err)
+	}
+}
+
+func TestCheckCSRF(t *testing.T) {
+	defer testSessions(t)()
+
+	alice := &loginSession{username: "alice", id: "YWxpY2U|1"}
+	bob := &loginSession{username: "bob", id: "Ym9i|1"}
+	request := func(header, form, origin string) *http.Request {
+		r := httptest.NewRequest("POST", "http://ql.example.com/users",
+			strings.NewReader(url.Values{csrfFormField: {form}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header != "" {
+			r.Header.Set(csrfHeader, header)
+		}
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return r
+	}
+	token := csrfToken(alice)
+	tests := []struct {
+		name string
+		r    *http.Request
+		ok   bool
+	}{
+		{"header", request(token, "", ""), true},
+		{"form", request("", token, ""), true},
+		{"same origin", request(token, "", "http://ql.example.com"), true},
+		{"missing", request("", "", ""), false},
+		{"other session's token", request(csrfToken(bob), "", ""), false},
+		{"tampered", request(token[:len(token)-1]+"x", "", ""), false},
+		{"wrong header, right form", request("x", token, ""), false},
+		{"other origin", request(token, "", "http://evil.example.com"), false},
+	}
+	for _, test := range tests {
+		if ok := checkCSRF(test.r, alice); ok != test.ok {
+			t.Errorf("%s: checkCSRF() = %v, want %v", test.name, ok, test.ok)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// shutdown.go - Stopping the web servers and closing websockets when
+// webqlrc exits.
+package web
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"webqlrc/config"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	closeFrameTimeout   = time.Second
+	closeCheckInterval  = 50 * time.Millisecond
+	shutdownCloseReason = "Server shutting down"
+)
+
+var (
+	httpServersMutex sync.Mutex
+	httpServers      []*http.Server
+	shuttingDown     bool
+	started          = make(chan struct{})
+)
+
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	httpServersMutex.Lock()
+	defer httpServersMutex.Unlock()
+	s := &http.Server{Addr: addr, Handler: handler}
+	if shuttingDown {
+		// Serving returns http.ErrServerClosed straight away
+		s.Close()
+	}
+	httpServers = append(httpServers, s)
+	return s
+}
+
+// Closed once Start has read the configuration and created the web server.
+// ShutdownTimeout and Shutdown must wait for it.
+func Started() <-chan struct{} {
+	return started
+}
+
+// How long shutting down may take in all
+func ShutdownTimeout() time.Duration {
+	return intToDuration(currentCfg().Web.WebShutdownTimeout, time.Second)
+}
+
+// Stop accepting HTTP requests, wait for those in progress, then send every
+// websocket a close frame and wait for the browsers to close them.
+func Shutdown(ctx context.Context) error {
+	if err := sdNotify("STOPPING=1"); err != nil {
+		log.Printf("webqlrcon %s: %s", config.Version, err)
+	}
+	httpServersMutex.Lock()
+	shuttingDown = true
+	servers := append([]*http.Server(nil), httpServers...)
+	httpServersMutex.Unlock()
+	var firstErr error
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			s.Close()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Unable to stop web server %s: %s",
+					s.Addr, err)
+			}
+		}
+	}
+	if err := closeWebSockets(ctx); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func openConns() int {
+	wsConnsMutex.Lock()
+	defer wsConnsMutex.Unlock()
+	return len(wsConns)
+}
+
+func closeWebSockets(ctx context.Context) error {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway,
+		shutdownCloseReason)
+	wsConnsMutex.Lock()
+	for c := range wsConns {
+		c.w.WriteControl(websocket.CloseMessage, msg,
+			time.Now().Add(closeFrameTimeout))
+	}
+	wsConnsMutex.Unlock()
+
+	// Each connection is untracked once its browser answers the close frame
+	ticker := time.NewTicker(closeCheckInterval)
+	defer ticker.Stop()
+	for openConns() > 0 {
+		select {
+		case <-ctx.Done():
+			n := openConns()
+			closeConns(func(c *webSocketConn) bool {
+				return true
+			})
+			return fmt.Errorf("%d websocket(s) did not close in time: %s", n,
+				ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
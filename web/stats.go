@@ -0,0 +1,139 @@
+// stats.go - Pages for stored matches and player careers.
+package web
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"webqlrc/rcon"
+	"webqlrc/storage"
+)
+
+const (
+	matchesRoute      = "/matches"
+	matchRoute        = "/matches/"
+	playerRoute       = "/players/"
+	matchesPageSize   = 50
+	connectionHistory = 50
+)
+
+type weaponRow struct {
+	Name string
+	*rcon.WeaponStats
+}
+
+func serveMatches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405: Not allowed", 405)
+		return
+	}
+	if _, _, err := currentUser(w, r, true); err != nil {
+		http.Redirect(w, r, getLoginRoute, http.StatusSeeOther)
+		return
+	}
+	matches, err := storage.Matches(matchesPageSize)
+	if err != nil {
+		log.Printf("Unable to list matches: %s", err)
+		http.Error(w, "500: Unable to read stats database", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		Matches    []*storage.Match
+		MainRoute  string
+		MatchRoute string
+	}{
+		matches,
+		mainRoute,
+		matchRoute,
+	}
+	matchesTemplate.Execute(w, data)
+}
+
+func serveMatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405: Not allowed", 405)
+		return
+	}
+	if _, _, err := currentUser(w, r, true); err != nil {
+		http.Redirect(w, r, getLoginRoute, http.StatusSeeOther)
+		return
+	}
+	guid := strings.TrimPrefix(r.URL.Path, matchRoute)
+	if guid == "" {
+		http.Redirect(w, r, matchesRoute, http.StatusSeeOther)
+		return
+	}
+	match, err := storage.GetMatch(guid)
+	if err != nil {
+		log.Printf("Unable to read match '%s': %s", guid, err)
+		http.Error(w, "500: Unable to read stats database", 500)
+		return
+	}
+	if match == nil {
+		http.Error(w, "404: Not found", 404)
+		return
+	}
+	// scoreboard order
+	sort.Slice(match.Players, func(i, j int) bool {
+		return match.Players[i].Score > match.Players[j].Score
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		Match        *storage.Match
+		MatchesRoute string
+		PlayerRoute  string
+	}{
+		match,
+		matchesRoute,
+		playerRoute,
+	}
+	matchTemplate.Execute(w, data)
+}
+
+func servePlayer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405: Not allowed", 405)
+		return
+	}
+	if _, _, err := currentUser(w, r, true); err != nil {
+		http.Redirect(w, r, getLoginRoute, http.StatusSeeOther)
+		return
+	}
+	steamid := strings.TrimPrefix(r.URL.Path, playerRoute)
+	career, history, err := storage.GetCareer(steamid, connectionHistory)
+	if err != nil {
+		log.Printf("Unable to read player '%s': %s", steamid, err)
+		http.Error(w, "500: Unable to read stats database", 500)
+		return
+	}
+	if career == nil && len(history) == 0 {
+		http.Error(w, "404: Not found", 404)
+		return
+	}
+	var weapons []weaponRow
+	if career != nil {
+		for name, ws := range career.Weapons {
+			weapons = append(weapons, weaponRow{name, ws})
+		}
+		sort.Slice(weapons, func(i, j int) bool {
+			return weapons[i].Kills > weapons[j].Kills
+		})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		SteamId      string
+		Career       *storage.Career
+		Weapons      []weaponRow
+		History      []*storage.Connection
+		MatchesRoute string
+	}{
+		steamid,
+		career,
+		weapons,
+		history,
+		matchesRoute,
+	}
+	playerTemplate.Execute(w, data)
+}
@@ -0,0 +1,194 @@
+// users.go - Admin page for managing web users and roles.
+package web
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"webqlrc/audit"
+	"webqlrc/config"
+
+	"github.com/apexskier/httpauth"
+)
+
+const usersRoute = "/users"
+
+type userRow struct {
+	Username string
+	Role     string
+	Disabled bool
+}
+
+func serveUsers(w http.ResponseWriter, r *http.Request) {
+	user, session, err := currentUser(w, r, true)
+	if err != nil || !isAdmin(user) {
+		http.Redirect(w, r, getLoginRoute, http.StatusSeeOther)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		listUsers(w, r, session)
+	case "POST":
+		if !checkCSRF(r, session) {
+			http.Error(w, "403: Forbidden", 403)
+			return
+		}
+		msg := changeUser(w, r, user)
+		http.Redirect(w, r, usersRoute+"?msg="+url.QueryEscape(msg),
+			http.StatusSeeOther)
+	default:
+		http.Error(w, "405: Not allowed", 405)
+	}
+}
+
+func listUsers(w http.ResponseWriter, r *http.Request, session *loginSession) {
+	users, err := config.ListWebUsers()
+	if err != nil {
+		log.Printf("Unable to read web users: %s", err)
+		http.Error(w, "500: Unable to read web users", 500)
+		return
+	}
+	rows := make([]userRow, len(users))
+	for i, u := range users {
+		state, err := config.GetWebUserState(u.Username)
+		if err != nil {
+			log.Printf("Unable to read web user state: %s", err)
+			http.Error(w, "500: Unable to read web users", 500)
+			return
+		}
+		rows[i] = userRow{u.Username, u.Role, state.Disabled}
+	}
+	roles := make([]string, 0, len(webroles))
+	for role := range webroles {
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		return webroles[roles[i]] < webroles[roles[j]]
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		Users     []userRow
+		Roles     []string
+		Message   string
+		CSRFToken string
+		MainRoute string
+	}{
+		rows,
+		roles,
+		r.FormValue("msg"),
+		csrfToken(session),
+		mainRoute,
+	}
+	usersTemplate.Execute(w, data)
+}
+
+// Apply the change posted by admin, recording it in the audit log. Returns
+// the message shown on the page afterwards.
+func changeUser(w http.ResponseWriter, r *http.Request,
+	admin httpauth.UserData) string {
+	action := r.PostFormValue("action")
+	username := r.PostFormValue("username")
+	command := fmt.Sprintf("%s %s", action, username)
+	var err error
+
+	switch action {
+	case "add":
+		role := r.PostFormValue("role")
+		command = fmt.Sprintf("add %s role=%s", username, role)
+		err = addUser(w, r, username, r.PostFormValue("password"), role)
+	case "passwd":
+		err = config.SetWebUserPassword(username, r.PostFormValue("password"))
+		// Anyone who knew the old password shouldn't stay logged in
+		if err == nil && username != admin.Username {
+			err = config.RevokeWebUserSessions(username)
+			closeUserConns(username)
+		}
+	case "role":
+		role := r.PostFormValue("role")
+		command = fmt.Sprintf("role %s role=%s", username, role)
+		err = config.SetWebUserRole(username, role)
+		// Websockets keep the role they connected with
+		if err == nil {
+			closeUserConns(username)
+		}
+	case "disable":
+		if username == admin.Username {
+			err = errors.New("You can't disable your own account")
+			break
+		}
+		err = config.SetWebUserDisabled(username, true)
+		if err == nil {
+			closeUserConns(username)
+		}
+	case "enable":
+		err = config.SetWebUserDisabled(username, false)
+	case "revoke":
+		err = config.RevokeWebUserSessions(username)
+		if err == nil {
+			closeUserConns(username)
+		}
+	case "delete":
+		err = deleteUser(username, admin.Username)
+	default:
+		err = fmt.Errorf("Unknown action '%s'", action)
+	}
+
+	e := &audit.Entry{
+		Type:       audit.TypeUser,
+		User:       admin.Username,
+		RemoteAddr: r.RemoteAddr,
+		Command:    command,
+		Allowed:    err == nil,
+	}
+	if err != nil {
+		e.Reason = err.Error()
+	}
+	audit.Record(e)
+
+	if err != nil {
+		return fmt.Sprintf("Unable to %s: %s", command, err)
+	}
+	log.Printf("webqlrcon %s: %s: %s", config.Version, admin.Username, command)
+	return fmt.Sprintf("Done: %s", command)
+}
+
+func addUser(w http.ResponseWriter, r *http.Request,
+	username, password, role string) error {
+	if err := config.ValidateWebUsername(username); err != nil {
+		return err
+	}
+	if err := config.ValidateWebRole(role); err != nil {
+		return err
+	}
+	if password == "" {
+		return errors.New("Password was not specified.")
+	}
+	return authorizer().Register(w, r, httpauth.UserData{
+		Username: username,
+		Email:    fmt.Sprintf("%s@localhost", username),
+		Role:     role,
+	}, password)
+}
+
+func deleteUser(username, admin string) error {
+	if username == admin {
+		return errors.New("You can't delete your own account")
+	}
+	user, err := webauthbackend.User(username)
+	if err != nil {
+		return fmt.Errorf("No such web user '%s'", username)
+	}
+	if user.Role == "admin" {
+		if err := config.CheckOtherAdmins(username); err != nil {
+			return err
+		}
+	}
+	if err := authorizer().DeleteUser(username); err != nil {
+		return err
+	}
+	closeUserConns(username)
+	return config.ForgetWebUser(username)
+}
@@ -2,52 +2,92 @@
 package web
 
 import (
+	"encoding/json"
 	"fmt"
+	"html/template"
 	"log"
+	"net"
 	"net/http"
-	"path"
-	"text/template"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
 	"time"
+	"webqlrc/audit"
 	"webqlrc/bridge"
 	"webqlrc/config"
+	"webqlrc/rcon"
 
 	"github.com/apexskier/httpauth"
 	"github.com/gorilla/websocket"
 )
 
 type webSocketConn struct {
-	w *websocket.Conn
+	w          *websocket.Conn
+	client     *bridge.WebClient
+	username   string
+	role       string
+	remoteAddr string
+	session    *loginSession
 }
 
 const (
 	mainRoute      = "/"
 	getLoginRoute  = "/login"
 	postLoginRoute = "/sendlogin"
+	logoutRoute    = "/logout"
+	sessionRoute   = "/session"
 	webSocketRoute = "/ws"
+	auditRoute     = "/audit"
+	auditPageSize  = 200
 )
 
 var (
-	cfg           *config.Config
-	loginTemplate = template.Must(template.ParseFiles("html/login_template.html"))
-	rootTemplate  = template.Must(template.ParseFiles("html/root_template.html"))
-	upgrader      = websocket.Upgrader{
+	cfg             *config.Config
+	rconcfg         *config.Config
+	cfgMutex        sync.RWMutex
+	loginTemplate   *template.Template
+	rootTemplate    *template.Template
+	auditTemplate   *template.Template
+	usersTemplate   *template.Template
+	matchesTemplate *template.Template
+	matchTemplate   *template.Template
+	playerTemplate  *template.Template
+	upgrader        = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		Subprotocols:    []string{jsonSubprotocol, textSubprotocol},
+		CheckOrigin:     checkOrigin,
 	}
-	webauthbackend httpauth.GobFileAuthBackend
-	webauthorizer  httpauth.Authorizer
+	webauthbackend = config.WebUsers
 	webroles       = config.WebRoles
-	wsconn         *webSocketConn
 )
 
+func currentCfg() *config.Config {
+	cfgMutex.RLock()
+	defer cfgMutex.RUnlock()
+	return cfg
+}
+
+func currentRconCfg() *config.Config {
+	cfgMutex.RLock()
+	defer cfgMutex.RUnlock()
+	return rconcfg
+}
+
 func intToDuration(val int, dur time.Duration) time.Duration {
 	return time.Duration(val) * dur
 }
 
 func (c *webSocketConn) readWebSocket() {
-	defer c.w.Close()
-	pongtimeout := intToDuration(cfg.Web.WebPongTimeout, time.Second)
-	c.w.SetReadLimit(cfg.Web.WebMaxMessageSize)
+	defer func() {
+		untrackConn(c)
+		bridge.MessageBridge.Unregister <- c.client
+		c.w.Close()
+	}()
+	webcfg := currentCfg().Web
+	pongtimeout := intToDuration(webcfg.WebPongTimeout, time.Second)
+	c.w.SetReadLimit(webcfg.WebMaxMessageSize)
 	c.w.SetReadDeadline(time.Now().Add(pongtimeout))
 	c.w.SetPongHandler(func(string) error {
 		c.w.SetReadDeadline(time.Now().Add(pongtimeout))
@@ -59,19 +99,60 @@ func (c *webSocketConn) readWebSocket() {
 		if err != nil {
 			break
 		}
+		m, err := c.decodeMessage(msg)
+		if err != nil {
+			c.sendError(nil, err)
+			continue
+		}
+		m.Client = c.client
+		c.session.touch()
+		err = authorizeCommand(c.role, string(m.Data))
+		c.audit(m, err)
+		if err != nil {
+			c.sendError(m, err)
+			continue
+		}
+		rcon.CountCommand(c.username, m.ServerId)
 		// Web UI (websocket) -> Rcon
-		bridge.MessageBridge.WebToRcon <- msg
+		bridge.MessageBridge.WebToRcon <- m
 	}
 }
 
+func (c *webSocketConn) audit(m *bridge.Message, authErr error) {
+	e := &audit.Entry{
+		Type:       audit.TypeCommand,
+		User:       c.username,
+		RemoteAddr: c.remoteAddr,
+		Server:     m.ServerId,
+		Command:    string(m.Data),
+		Allowed:    authErr == nil,
+	}
+	if authErr != nil {
+		e.Reason = authErr.Error()
+	}
+	audit.Record(e)
+}
+
+// Send an error back to this connection only. orig is the message that
+// caused it, if any.
+func (c *webSocketConn) sendError(orig *bridge.Message, err error) {
+	m := bridge.NewMessage(bridge.MsgError, "", []byte(err.Error()))
+	if orig != nil {
+		m.ServerId = orig.ServerId
+		m.CorrelationId = orig.CorrelationId
+	}
+	m.Client = c.client
+	bridge.MessageBridge.RconToWeb <- m
+}
+
 func (c *webSocketConn) write(msgtype int, contents []byte) error {
-	c.w.SetWriteDeadline(time.Now().Add(intToDuration(cfg.Web.WebSendTimeout,
+	c.w.SetWriteDeadline(time.Now().Add(intToDuration(currentCfg().Web.WebSendTimeout,
 		time.Second)))
 	return c.w.WriteMessage(msgtype, contents)
 }
 
 func (c *webSocketConn) writeWebSocket() {
-	pingTicker := time.NewTicker(intToDuration((cfg.Web.WebPongTimeout*9)/10,
+	pingTicker := time.NewTicker(intToDuration((currentCfg().Web.WebPongTimeout*9)/10,
 		time.Second))
 	defer func() {
 		pingTicker.Stop()
@@ -80,12 +161,17 @@ func (c *webSocketConn) writeWebSocket() {
 	for {
 		select {
 		// recv msg from bridge (i.e. from rcon) that needs to go out to UI via websocket
-		case msg, ok := <-bridge.MessageBridge.OutToWeb:
+		case msg, ok := <-c.client.Send:
 			if !ok {
 				c.write(websocket.CloseMessage, []byte{})
 				return
 			}
-			if err := c.write(websocket.TextMessage, msg); err != nil {
+			out, err := c.encodeMessage(msg)
+			if err != nil {
+				log.Printf("Unable to encode websocket message: %s", err)
+				continue
+			}
+			if err := c.write(websocket.TextMessage, out); err != nil {
 				return
 			}
 		// ping
@@ -105,9 +191,11 @@ func serveGetLogin(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	data := struct {
 		Messages       []string
+		Throttled      bool
 		PostLoginRoute string
 	}{
-		webauthorizer.Messages(w, r),
+		authorizer().Messages(w, r),
+		r.FormValue("throttled") != "",
 		postLoginRoute,
 	}
 	loginTemplate.Execute(w, data)
@@ -120,12 +208,112 @@ func servePostLogin(w http.ResponseWriter, r *http.Request) {
 	}
 	username := r.PostFormValue("username")
 	password := r.PostFormValue("password")
-	if err := webauthorizer.Login(w, r, username, password,
-		mainRoute); err != nil && err.Error() == "already authenticated" {
+	address, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		address = r.RemoteAddr
+	}
+	keys := config.LoginKeys(username, address)
+	limits := currentCfg().Web.LoginLimits()
+	// The attempt counts as failed until the password has been checked, so
+	// concurrent attempts can't get past the limits
+	wait, locked, err := config.StartLoginAttempt(keys, limits)
+	if err != nil {
+		log.Printf("Unable to check login attempts: %s", err)
+	}
+	if err != nil || wait > 0 {
+		logins.Inc("throttled")
+		http.Redirect(w, r, getLoginRoute+"?throttled=1", http.StatusSeeOther)
+		return
+	}
+	if state, err := config.GetWebUserState(username); err != nil ||
+		state.Disabled {
+		logins.Inc("failure")
+		loginFailed(locked, limits, username, r.RemoteAddr)
+		http.Redirect(w, r, getLoginRoute, http.StatusSeeOther)
+		return
+	}
+	// Login writes the response on success, so the session cookie has to
+	// be set before knowing whether it will succeed
+	startSession(w, r, username)
+	err = authorizer().Login(w, r, username, password, mainRoute)
+	if err != nil && err.Error() == "already authenticated" {
+		// No password was checked, so this says nothing about username
+		if err := config.CancelLoginAttempt(keys, locked); err != nil {
+			log.Printf("Unable to update failed logins: %s", err)
+		}
+		unsetSession(w)
 		http.Redirect(w, r, mainRoute, http.StatusSeeOther)
 	} else if err != nil {
+		unsetSession(w)
+		logins.Inc("failure")
+		loginFailed(locked, limits, username, r.RemoteAddr)
+		http.Redirect(w, r, getLoginRoute, http.StatusSeeOther)
+	} else {
+		logins.Inc("success")
+		if err := config.LoginSucceeded(keys, locked); err != nil {
+			log.Printf("Unable to clear failed logins: %s", err)
+		}
+	}
+}
+
+// Record the lockouts caused by a failed login
+func loginFailed(locked []string, limits *config.LoginLimits, username,
+	remoteAddr string) {
+	for _, key := range locked {
+		reason := fmt.Sprintf("Too many failed logins, locked out for %s",
+			limits.Lockout)
+		audit.Record(&audit.Entry{
+			Type:       audit.TypeLockout,
+			User:       username,
+			RemoteAddr: remoteAddr,
+			Command:    "lockout " + config.DescribeLoginKey(key),
+			Reason:     reason,
+		})
+		log.Printf("webqlrcon %s: Login locked out for %s: %s",
+			config.Version, config.DescribeLoginKey(key), reason)
+	}
+}
+
+func serveLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "405: Not allowed", 405)
+		return
+	}
+	_, session, err := currentUser(w, r, false)
+	if err != nil {
 		http.Redirect(w, r, getLoginRoute, http.StatusSeeOther)
+		return
 	}
+	if !checkCSRF(r, session) {
+		http.Error(w, "403: Forbidden", 403)
+		return
+	}
+	endSession(session)
+	authorizer().Logout(w, r)
+	clearSession(w)
+	http.Redirect(w, r, getLoginRoute, http.StatusSeeOther)
+}
+
+// Keeps the session from going idle, and tells the page when it expires
+func serveSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405: Not allowed", 405)
+		return
+	}
+	_, session, err := currentUser(w, r, false)
+	if err != nil {
+		http.Error(w, "401: Not authorized", 401)
+		return
+	}
+	_, idle := sessionLifetimes()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ExpiresIn   int64 `json:"expires_in"`
+		IdleTimeout int64 `json:"idle_timeout"`
+	}{
+		int64(session.expiresIn() / time.Millisecond),
+		int64(idle / time.Millisecond),
+	})
 }
 
 func serveRoot(w http.ResponseWriter, r *http.Request) {
@@ -137,65 +325,243 @@ func serveRoot(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "405: Not allowed", 405)
 		return
 	}
-	if err := webauthorizer.Authorize(w, r, true); err != nil {
+	user, session, err := currentUser(w, r, true)
+	if err != nil {
 		http.Redirect(w, r, getLoginRoute, http.StatusSeeOther)
 		return
 	}
-	if user, err := webauthorizer.CurrentUser(w, r); err == nil {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		data := struct {
-			User httpauth.UserData
-			Host string
-		}{
-			user,
-			r.Host,
-		}
-		rootTemplate.Execute(w, data)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	servers := currentRconCfg().Rcon.Servers
+	serverids := make([]string, len(servers))
+	for i, s := range servers {
+		serverids[i] = s.Id
+	}
+	wsscheme := "ws"
+	if r.TLS != nil {
+		wsscheme = "wss"
+	}
+	_, idle := sessionLifetimes()
+	data := struct {
+		User         httpauth.UserData
+		Host         string
+		WsScheme     string
+		Servers      []string
+		AuditRoute   string
+		MatchesRoute string
+		ReloadRoute  string
+		UsersRoute   string
+		LoginRoute   string
+		LogoutRoute  string
+		SessionRoute string
+		CSRFToken    string
+		// milliseconds, for the expiry warning
+		SessionExpiresIn   int64
+		SessionIdleTimeout int64
+	}{
+		user,
+		r.Host,
+		wsscheme,
+		serverids,
+		auditRoute,
+		matchesRoute,
+		reloadRoute,
+		usersRoute,
+		getLoginRoute,
+		logoutRoute,
+		sessionRoute,
+		csrfToken(session),
+		int64(session.expiresIn() / time.Millisecond),
+		int64(idle / time.Millisecond),
+	}
+	rootTemplate.Execute(w, data)
+}
+
+func serveAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405: Not allowed", 405)
+		return
+	}
+	user, _, err := currentUser(w, r, true)
+	if err != nil || !isAdmin(user) {
+		http.Redirect(w, r, getLoginRoute, http.StatusSeeOther)
+		return
+	}
+	query := r.FormValue("q")
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = auditPageSize
+	}
+	entries, err := audit.Search(query, limit)
+	if err != nil {
+		log.Printf("Unable to search audit log: %s", err)
+		http.Error(w, "500: Unable to read audit log", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		Query     string
+		Limit     int
+		Entries   []*audit.Entry
+		MainRoute string
+	}{
+		query,
+		limit,
+		entries,
+		mainRoute,
 	}
+	auditTemplate.Execute(w, data)
 }
 
 func serveWs(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "405: Not allowed", 405)
+		return
+	}
+	user, session, err := currentUser(w, r, false)
+	if err != nil {
+		http.Error(w, "401: Not authorized", 401)
+		return
 	}
 	websock, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	wsconn = &webSocketConn{w: websock}
+	wsconn := &webSocketConn{
+		w:          websock,
+		client:     bridge.NewWebClient(),
+		username:   user.Username,
+		role:       user.Role,
+		remoteAddr: r.RemoteAddr,
+		session:    session,
+	}
+	bridge.MessageBridge.Register <- wsconn.client
+	trackConn(wsconn)
 	go wsconn.writeWebSocket()
 	wsconn.readWebSocket()
 }
 
+// Redirect plain HTTP requests on fromPort to HTTPS on toPort
+func startHTTPRedirect(fromPort, toPort int) {
+	log.Printf("webqlrcon %s: Redirecting http://localhost:%d to HTTPS",
+		config.Version, fromPort)
+	err := newHTTPServer(fmt.Sprintf(":%d", fromPort),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = r.Host
+			}
+			target := url.URL{
+				Scheme:   "https",
+				Host:     net.JoinHostPort(host, strconv.Itoa(toPort)),
+				Path:     r.URL.Path,
+				RawQuery: r.URL.RawQuery,
+			}
+			http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+		})).ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("FATAL: unable to start HTTP redirect listener: %s", err)
+	}
+}
+
+// Templates are relative to the working directory, so they are parsed by
+// Start rather than when the package is loaded
+func parseTemplate(name string) *template.Template {
+	t, err := template.ParseFiles("html/" + name)
+	if err != nil {
+		log.Fatalf("FATAL: unable to read HTML template: %s", err)
+	}
+	return t
+}
+
+// Serve the web interface. Returns once Shutdown has been called.
 func Start() {
 	var err error
+	cfgMutex.Lock()
 	cfg, err = config.ReadConfig(config.WEB)
 	if err != nil {
 		log.Fatalf("FATAL: unable to read web configuration file: %s", err)
 	}
+	rconcfg, err = config.ReadConfig(config.RCON)
+	if err != nil {
+		log.Fatalf("FATAL: unable to read RCON configuration file: %s", err)
+	}
+	cfgMutex.Unlock()
+	loginTemplate = parseTemplate("login_template.html")
+	rootTemplate = parseTemplate("root_template.html")
+	auditTemplate = parseTemplate("audit_template.html")
+	usersTemplate = parseTemplate("users_template.html")
+	matchesTemplate = parseTemplate("matches_template.html")
+	matchTemplate = parseTemplate("match_template.html")
+	playerTemplate = parseTemplate("player_template.html")
 	port := fmt.Sprintf(":%d", cfg.Web.WebServerPort)
-	log.Printf("webqlrcon %s: Starting web server on http://localhost%s",
-		config.Version, port)
+	scheme := "http"
+	if cfg.Web.TLSEnabled() {
+		scheme = "https"
+	}
+	log.Printf("webqlrcon %s: Starting web server on %s://localhost%s",
+		config.Version, scheme, port)
 
-	webauthbackend, err := httpauth.NewGobFileAuthBackend(path.Join(config.ConfigurationDirectory,
-		config.WebUserFilename))
+	err = audit.Open(config.FilePath(config.AuditLogFilename),
+		cfg.Web.WebAuditMaxSize, cfg.Web.WebAuditMaxFiles)
 	if err != nil {
-		log.Fatalf("FATAL: unable to create web authorization backend: %s", err)
+		log.Fatalf("FATAL: unable to open audit log: %s", err)
 	}
 
-	webauthorizer, err = httpauth.NewAuthorizer(webauthbackend,
-		[]byte("cookie-encryption-key"), "admin", webroles)
+	cookiekey, err := config.ReadCookieKey()
+	if os.IsNotExist(err) {
+		log.Printf("webqlrcon %s: No cookie key found, generating one in '%s'",
+			config.Version, config.WebCookieKeyFilename)
+		cookiekey, err = config.GenerateCookieKey()
+	}
 	if err != nil {
+		log.Fatalf("FATAL: unable to load cookie key: %s", err)
+	}
+
+	if err := setCookieKey(cookiekey); err != nil {
 		log.Fatalf("FATAL: unable to create web authorizer: %s", err)
 	}
+	go sweepSessions()
 
 	http.HandleFunc(mainRoute, serveRoot)
 	http.HandleFunc(getLoginRoute, serveGetLogin)
 	http.HandleFunc(postLoginRoute, servePostLogin)
+	http.HandleFunc(logoutRoute, serveLogout)
+	http.HandleFunc(sessionRoute, serveSession)
 	http.HandleFunc(webSocketRoute, serveWs)
-	err = http.ListenAndServe(port, nil)
+	http.HandleFunc(apiServersRoute, serveAPIServers)
+	http.HandleFunc(apiServerRoute, serveAPIServer)
+	http.HandleFunc(auditRoute, serveAudit)
+	http.HandleFunc(reloadRoute, serveReload)
+	http.HandleFunc(usersRoute, serveUsers)
+	http.HandleFunc(matchesRoute, serveMatches)
+	http.HandleFunc(matchRoute, serveMatch)
+	http.HandleFunc(playerRoute, servePlayer)
+	http.HandleFunc(healthRoute, serveHealth)
+	http.HandleFunc(readyRoute, serveReady)
+	if cfg.Web.WebMetricsAddress != "" {
+		go startMetricsListener(cfg.Web.WebMetricsAddress)
+	} else {
+		http.HandleFunc(metricsRoute, serveMetrics)
+	}
+	ln, err := net.Listen("tcp", port)
 	if err != nil {
 		log.Fatalf("FATAL: unable to start webserver: %s", err)
 	}
+	sdStarted()
+	server := newHTTPServer(port, nil)
+	close(started)
+	if cfg.Web.TLSEnabled() {
+		if cfg.Web.WebHTTPRedirectPort != 0 {
+			go startHTTPRedirect(cfg.Web.WebHTTPRedirectPort,
+				cfg.Web.WebServerPort)
+		}
+		err = server.ServeTLS(ln, cfg.Web.WebTLSCertFile,
+			cfg.Web.WebTLSKeyFile)
+	} else {
+		err = server.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("FATAL: unable to start webserver: %s", err)
+	}
 }